@@ -0,0 +1,115 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Anyone with the link can download files
+	DOWNLOAD_AUTH_PUBLIC = "public"
+	// Every download needs credentials
+	DOWNLOAD_AUTH_AUTHENTICATED = "authenticated"
+	// Only files uploaded with private=true need credentials
+	DOWNLOAD_AUTH_PER_FILE = "per-file"
+)
+
+// Users and tokens with the read-private scope can read files that need credentials
+func canReadPrivate(c *gin.Context) bool {
+	credentials := getCredentials(c)
+	return credentials != nil && (credentials.user != "" || credentials.token.HasScope(SCOPE_READ_PRIVATE))
+}
+
+// Rejects requests that can not read files needing credentials, see canReadPrivate
+func requireReadPrivate(c *gin.Context) {
+	switch {
+	case getCredentials(c) == nil:
+		abortUnauthorized(c)
+		return
+	case !canReadPrivate(c):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("the '%s' scope is required", SCOPE_READ_PRIVATE)})
+		return
+	}
+	c.Next()
+}
+
+// Whether the request can see a file, according to DOWNLOAD_AUTH
+func canRead(c *gin.Context, private bool) bool {
+	switch GetSettings().DownloadAuth {
+	case DOWNLOAD_AUTH_AUTHENTICATED:
+		return canReadPrivate(c)
+	case DOWNLOAD_AUTH_PER_FILE:
+		return !private || canReadPrivate(c)
+	}
+	return true
+}
+
+// Asks for credentials, or rejects the ones without the read-private scope, before routes with a :name, or :name and *path, reveal anything about a file
+// that needs them. Files that do not exist are left to the handlers
+func requireReadAccess(c *gin.Context) {
+	settings := GetSettings()
+	if settings.DownloadAuth == DOWNLOAD_AUTH_PUBLIC {
+		c.Next()
+		return
+	}
+	// Signed URLs are checked before looking at the file so they work whatever it is
+	var signatureErr error
+	if query := c.Request.URL.Query(); IsSigned(query) {
+		if signatureErr = VerifySignedPath(settings.URLSigningKeys, c.Request.URL.Path, query, time.Now()); signatureErr == nil {
+			c.Next()
+			return
+		}
+	}
+
+	private := false
+	if settings.DownloadAuth == DOWNLOAD_AUTH_PER_FILE && c.Param("name") != "" {
+		var row fileRow
+		var err error
+		if alias := strings.TrimPrefix(c.Param("path"), "/"); alias != "" {
+			// Handlers reject invalid versions
+			version, _ := aliasVersion(c)
+			row, err = GetDB().findByAlias(c.Param("name"), alias, version)
+		} else {
+			row, err = GetDB().findByShortName(c.Param("name"))
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			slog.Error(fmt.Sprintf("Failed to check if %s is private: %s", c.Request.URL.Path, err))
+		}
+		private = err == nil && row.private
+	}
+
+	if !canRead(c, private) {
+		if signatureErr != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": signatureErr.Error()})
+			return
+		}
+		if getCredentials(c) != nil {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		abortUnauthorized(c)
+		return
+	}
+	c.Next()
+}
+
+// Asks for credentials before bucket listings when DOWNLOAD_AUTH needs them for every file. Private
+// files are left out of the listing for requests that can not read them
+func requireListAccess(c *gin.Context) {
+	if canRead(c, false) {
+		c.Next()
+		return
+	}
+	if getCredentials(c) != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	abortUnauthorized(c)
+}
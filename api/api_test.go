@@ -1,6 +1,7 @@
 package api_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/matheusfillipe/girafiles/api"
@@ -26,3 +27,41 @@ func TestIToString(t *testing.T) {
 		}
 	}
 }
+
+func TestObfuscateIdx(t *testing.T) {
+	t.Parallel()
+
+	// Every short name of the two and three character blocks and part of the four character one
+	seen := map[string]bool{}
+	for i := int64(0); i < 1000000; i++ {
+		s := api.ObfuscateIdx(i)
+		if len(s) != len(api.IdxToString(i)) {
+			t.Fatalf("Expected %s to have the length of %s", s, api.IdxToString(i))
+		}
+		if seen[s] {
+			t.Fatalf("Duplicate obfuscated name %s for %d", s, i)
+		}
+		seen[s] = true
+	}
+
+	if api.ObfuscateIdx(1) == api.IdxToString(1) && api.ObfuscateIdx(2) == api.IdxToString(2) {
+		t.Fatal("Expected obfuscated names to differ from sequential ones")
+	}
+}
+
+func TestRandomShortname(t *testing.T) {
+	t.Parallel()
+
+	a, b := api.RandomShortname(8), api.RandomShortname(8)
+	if len(a) != 8 || len(b) != 8 {
+		t.Fatalf("Expected length of 8, got %s and %s", a, b)
+	}
+	if a == b {
+		t.Fatalf("Expected different random names, got %s twice", a)
+	}
+	for _, c := range a + b {
+		if !strings.ContainsRune(api.BASE62_ALPHABET, c) {
+			t.Fatalf("Unexpected character %c", c)
+		}
+	}
+}
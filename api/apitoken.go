@@ -0,0 +1,258 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Upload files
+	SCOPE_UPLOAD = "upload"
+	// Delete any file without its deletion token
+	SCOPE_DELETE = "delete"
+	// Download password protected files without their password
+	SCOPE_READ_PRIVATE = "read-private"
+	// Everything else, like fsck and managing tokens. Implies every other scope
+	SCOPE_ADMIN = "admin"
+)
+
+var SCOPES = []string{SCOPE_UPLOAD, SCOPE_DELETE, SCOPE_READ_PRIVATE, SCOPE_ADMIN}
+
+// Makes API tokens recognizable, in leaked logs for example
+const API_TOKEN_PREFIX = "gira_"
+
+// last_used_at is only updated this often to not write on every request
+const API_TOKEN_TOUCH_INTERVAL = time.Minute
+
+// Gin context key of the requestCredentials
+const CREDENTIALS_KEY = "credentials"
+
+var ErrUnknownScope = fmt.Errorf("unknown scope. Expected one of %s", strings.Join(SCOPES, ", "))
+
+type ApiToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func (t ApiToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, SCOPE_ADMIN)
+}
+
+// Parses a comma separated list of scopes
+func ParseScopes(value string) ([]string, error) {
+	scopes := []string{}
+	for _, scope := range strings.Split(value, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" || slices.Contains(scopes, scope) {
+			continue
+		}
+		if !slices.Contains(SCOPES, scope) {
+			return nil, fmt.Errorf("%w: '%s'", ErrUnknownScope, scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required. Expected some of %s", strings.Join(SCOPES, ", "))
+	}
+	return scopes, nil
+}
+
+// Creates a token and returns it with its secret. Only a hash of the secret is stored so it is not shown again.
+// A zero expiresAt never expires
+func CreateApiToken(name string, scopes []string, expiresAt time.Time) (ApiToken, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return ApiToken{}, "", errors.New("a token name is required")
+	}
+	// Times are stored in seconds
+	token := ApiToken{Name: name, Scopes: scopes, CreatedAt: time.Now().Truncate(time.Second)}
+	if !expiresAt.IsZero() {
+		expiresAt = expiresAt.Truncate(time.Second)
+		token.ExpiresAt = &expiresAt
+	}
+	secret := API_TOKEN_PREFIX + randomToken()
+	if err := GetDB().insertApiToken(&token, hashToken(secret)); err != nil {
+		return ApiToken{}, "", err
+	}
+	return token, secret, nil
+}
+
+func ApiTokens() ([]ApiToken, error) {
+	return GetDB().apiTokens()
+}
+
+// Returns sql.ErrNoRows if there is no token with the id
+func RevokeApiToken(id int64) error {
+	return GetDB().deleteApiToken(id)
+}
+
+// Who made a request. Users from USERS have every scope except read-private, they had no way
+// around file passwords before tokens existed
+type requestCredentials struct {
+	user  string
+	token *ApiToken
+}
+
+func (r *requestCredentials) hasScope(scope string) bool {
+	if r == nil {
+		return false
+	}
+	if r.user != "" {
+		return scope != SCOPE_READ_PRIVATE
+	}
+	return r.token.HasScope(scope)
+}
+
+// Token from the Authorization: Bearer header. Unknown and expired tokens are nil
+func bearerToken(c *gin.Context) *ApiToken {
+	header := c.GetHeader("Authorization")
+	secret, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || secret == "" {
+		return nil
+	}
+	now := time.Now()
+	db := GetDB()
+	token, err := db.findApiToken(hashToken(strings.TrimSpace(secret)), now)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error(fmt.Sprintf("Failed to look up API token: %s", err))
+		}
+		return nil
+	}
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > API_TOKEN_TOUCH_INTERVAL {
+		if err := db.touchApiToken(token.ID, now); err != nil {
+			slog.Error(fmt.Sprintf("Failed to update API token %d: %s", token.ID, err))
+		}
+	}
+	return &token
+}
+
+// Credentials of the request, nil without valid ones. Looked up once per request
+func getCredentials(c *gin.Context) *requestCredentials {
+	if value, exists := c.Get(CREDENTIALS_KEY); exists {
+		return value.(*requestCredentials)
+	}
+	var credentials *requestCredentials
+	if c.GetHeader("Authorization") == "" {
+		c.Set(CREDENTIALS_KEY, credentials)
+		return credentials
+	}
+	allowed, done := allowAuthAttempt(c)
+	if allowed {
+		if user, ok := basicAuthUser(c); ok {
+			credentials = &requestCredentials{user: user}
+		} else if token := bearerToken(c); token != nil {
+			credentials = &requestCredentials{token: token}
+		}
+		done(credentials != nil)
+	}
+	c.Set(CREDENTIALS_KEY, credentials)
+	return credentials
+}
+
+// Whether the request is allowed to do what scope covers. Requests without credentials never are
+func hasScope(c *gin.Context, scope string) bool {
+	return getCredentials(c).hasScope(scope)
+}
+
+// Rejects requests with credentials that do not cover scope. Requests without credentials are only let
+// through for the upload scope while authentication is disabled
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credentials := getCredentials(c)
+		switch {
+		case credentials == nil && scope == SCOPE_UPLOAD && !GetSettings().IsAuthEnabled():
+		case credentials == nil:
+			abortUnauthorized(c)
+			return
+		case !credentials.hasScope(scope):
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("the '%s' scope is required", scope)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Rejects credentials that are not an API token. Browsers send cached Basic auth credentials along with
+// requests made by pages of this origin, like uploaded HTML files, which must not be able to mint tokens
+func requireApiToken(c *gin.Context) {
+	credentials := getCredentials(c)
+	switch {
+	case credentials == nil:
+		abortUnauthorized(c)
+		return
+	case credentials.token == nil:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "an API token is required, create the first one with 'girafiles token create'"})
+		return
+	}
+	c.Next()
+}
+
+// Token management under /api/tokens, the group is expected to require an API token with the admin scope
+func addTokenRoutes(tokens *gin.RouterGroup) {
+	tokens.GET("", func(c *gin.Context) {
+		list, err := ApiTokens()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+	tokens.POST("", func(c *gin.Context) {
+		var request struct {
+			Name    string   `json:"name"`
+			Scopes  []string `json:"scopes"`
+			Expires string   `json:"expires"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		scopes, err := ParseScopes(strings.Join(request.Scopes, ","))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var expiresAt time.Time
+		if request.Expires != "" {
+			if expiresAt, err = ParseExpiry(request.Expires, time.Now()); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		token, secret, err := CreateApiToken(request.Name, scopes, expiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"token": secret, "info": token})
+	})
+	tokens.DELETE("/:id", func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expected a numeric token id"})
+			return
+		}
+		if err := RevokeApiToken(id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Token revoked"})
+	})
+}
@@ -0,0 +1,41 @@
+package api_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/matheusfillipe/girafiles/api"
+)
+
+func TestParseScopes(t *testing.T) {
+	t.Parallel()
+
+	scopes, err := api.ParseScopes(" upload,delete, upload,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 2 || scopes[0] != api.SCOPE_UPLOAD || scopes[1] != api.SCOPE_DELETE {
+		t.Fatalf("Expected upload and delete, got %v", scopes)
+	}
+	if _, err := api.ParseScopes("upload,root"); !errors.Is(err, api.ErrUnknownScope) {
+		t.Fatalf("Expected an unknown scope error, got %v", err)
+	}
+	if _, err := api.ParseScopes(" , "); err == nil {
+		t.Fatal("Expected an error without scopes")
+	}
+}
+
+func TestApiTokenHasScope(t *testing.T) {
+	t.Parallel()
+
+	token := api.ApiToken{Scopes: []string{api.SCOPE_UPLOAD}}
+	if !token.HasScope(api.SCOPE_UPLOAD) || token.HasScope(api.SCOPE_DELETE) || token.HasScope(api.SCOPE_ADMIN) {
+		t.Fatalf("Expected only the upload scope, got %v", token.Scopes)
+	}
+	admin := api.ApiToken{Scopes: []string{api.SCOPE_ADMIN}}
+	for _, scope := range api.SCOPES {
+		if !admin.HasScope(scope) {
+			t.Fatalf("Expected admin to imply %s", scope)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	STORAGE_BACKEND_LOCAL = "local"
+	STORAGE_BACKEND_S3    = "s3"
+)
+
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Where file contents are kept. Names are the blob names stored in the database.
+// Missing objects are reported with errors satisfying os.IsNotExist.
+type Storage interface {
+	// Stores src under name replacing any existing object atomically
+	Put(name string, src io.Reader, size int64) error
+	// Opens the object for reading. The caller must close it
+	Get(name string) (io.ReadSeekCloser, ObjectInfo, error)
+	Stat(name string) (ObjectInfo, error)
+	Delete(name string) error
+	List() ([]ObjectInfo, error)
+	// Total size of all objects in bytes
+	Size() (int64, error)
+}
+
+var storageInstanceLock = &sync.Mutex{}
+var storageInstance Storage
+
+func newStorage(settings *Settings) (Storage, error) {
+	switch settings.StorageBackend {
+	case STORAGE_BACKEND_S3:
+		return NewS3Storage(settings.S3)
+	case STORAGE_BACKEND_LOCAL, "":
+		return NewLocalStorage(settings.GetFileStoragePath()), nil
+	}
+	log.Fatalf("Unknown STORAGE_BACKEND '%s'. Expected '%s' or '%s'", settings.StorageBackend, STORAGE_BACKEND_LOCAL, STORAGE_BACKEND_S3)
+	return nil, nil
+}
+
+func GetStorage() Storage {
+	if storageInstance == nil {
+		storageInstanceLock.Lock()
+		defer storageInstanceLock.Unlock()
+		if storageInstance == nil {
+			storage, err := newStorage(GetSettings())
+			if err != nil {
+				log.Fatalf("Failed to initialize storage backend: %s", err)
+			}
+			storageInstance = storage
+		}
+	}
+	return storageInstance
+}
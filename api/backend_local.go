@@ -0,0 +1,124 @@
+package api
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stores every object as a file inside a single directory
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+// If src is a file on the same filesystem it is moved into place instead of copied
+func (s *LocalStorage) Put(name string, src io.Reader, size int64) error {
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return err
+	}
+	dst := s.path(name)
+
+	if f, ok := src.(*os.File); ok {
+		if err := os.Rename(f.Name(), dst); err == nil {
+			return nil
+		}
+	}
+
+	// Write next to the destination and rename so readers never see partial files
+	tmp, err := os.CreateTemp(s.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, src); err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		if rerr := os.Remove(tmp.Name()); rerr != nil && !os.IsNotExist(rerr) {
+			slog.Error("Failed to remove temporary file", "file", tmp.Name(), "error", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) Get(name string) (io.ReadSeekCloser, ObjectInfo, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		if cerr := f.Close(); cerr != nil {
+			slog.Error("Failed to close file", "error", cerr)
+		}
+		return nil, ObjectInfo{}, err
+	}
+	return f, ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalStorage) Stat(name string) (ObjectInfo, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *LocalStorage) List() ([]ObjectInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ObjectInfo{}, nil
+		}
+		return nil, err
+	}
+
+	objects := []ObjectInfo{}
+	for _, entry := range entries {
+		// Skip directories and unfinished writes
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		objects = append(objects, ObjectInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return objects, nil
+}
+
+func (s *LocalStorage) Size() (int64, error) {
+	objects, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, object := range objects {
+		size += object.Size
+	}
+	return size, nil
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Config struct {
+	// host[:port] of the S3 compatible service
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+	// Prepended to every object name, e.g. "girafiles/"
+	Prefix string
+}
+
+// Stores every object in a bucket of an S3 compatible service
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required for the s3 storage backend")
+	}
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return nil, err
+		}
+	}
+	return &S3Storage{client: client, bucket: config.Bucket, prefix: config.Prefix}, nil
+}
+
+func (s *S3Storage) key(name string) string {
+	return s.prefix + name
+}
+
+// Converts missing key errors into errors satisfying os.IsNotExist
+func (s *S3Storage) wrapErr(op string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	code := minio.ToErrorResponse(err).Code
+	if code == "NoSuchKey" || code == "NotFound" {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+func (s *S3Storage) Put(name string, src io.Reader, size int64) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), src, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (s *S3Storage) Get(name string) (io.ReadSeekCloser, ObjectInfo, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, s.wrapErr("get", name, err)
+	}
+	// GetObject is lazy, stat forces the request so missing objects are reported here
+	stat, err := object.Stat()
+	if err != nil {
+		_ = object.Close()
+		return nil, ObjectInfo{}, s.wrapErr("get", name, err)
+	}
+	return object, ObjectInfo{Name: name, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+func (s *S3Storage) Stat(name string) (ObjectInfo, error) {
+	stat, err := s.client.StatObject(context.Background(), s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s.wrapErr("stat", name, err)
+	}
+	return ObjectInfo{Name: name, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+func (s *S3Storage) Delete(name string) error {
+	// S3 deletes are idempotent, keep the local backend semantics for missing objects
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) List() ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: s.prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		name := strings.TrimPrefix(object.Key, s.prefix)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		objects = append(objects, ObjectInfo{Name: name, Size: object.Size, ModTime: object.LastModified})
+	}
+	return objects, nil
+}
+
+func (s *S3Storage) Size() (int64, error) {
+	objects, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, object := range objects {
+		size += object.Size
+	}
+	return size, nil
+}
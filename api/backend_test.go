@@ -0,0 +1,136 @@
+package api_test
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/matheusfillipe/girafiles/api"
+)
+
+// Runs the same checks against every storage backend
+func testStorage(t *testing.T, storage api.Storage) {
+	content := []byte("some content that will be stored")
+
+	if _, err := storage.Stat("missing.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error for missing object, got %v", err)
+	}
+	if _, _, err := storage.Get("missing.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error for missing object, got %v", err)
+	}
+
+	if err := storage.Put("a.txt", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put("b.txt", bytes.NewReader(content[:4]), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := storage.Stat("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Fatalf("Expected size %d, got %d", len(content), info.Size)
+	}
+
+	reader, info, err := storage.Get("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Fatalf("Expected size %d, got %d", len(content), info.Size)
+	}
+	if _, err := reader.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[5:]) {
+		t.Fatalf("Expected %q, got %q", content[5:], got)
+	}
+
+	objects, err := storage.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("Expected 2 objects, got %v", objects)
+	}
+
+	size, err := storage.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content))+4 {
+		t.Fatalf("Expected total size %d, got %d", len(content)+4, size)
+	}
+
+	if err := storage.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Stat("a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error after delete, got %v", err)
+	}
+	if err := storage.Delete("a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error deleting twice, got %v", err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "data")
+	testStorage(t, api.NewLocalStorage(dir))
+
+	// Files are moved into place instead of copied
+	storage := api.NewLocalStorage(dir)
+	tmp, err := os.CreateTemp(filepath.Dir(dir), "upload-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmp.WriteString("moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put("moved.txt", tmp, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp.Name()); !os.IsNotExist(err) {
+		t.Fatalf("Expected temporary file to be moved, got %v", err)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+	defer server.Close()
+
+	storage, err := api.NewS3Storage(api.S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Bucket:    "girafiles",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Region:    "us-east-1",
+		UseSSL:    false,
+		Prefix:    "files/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+}
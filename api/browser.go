@@ -1,6 +1,10 @@
 package api
 
-import "strings"
+import (
+	"mime"
+	"path"
+	"strings"
+)
 
 var SUP_MIMETYPES_PRE = []string{
 	"text",
@@ -55,3 +59,15 @@ func isSupportedMimetype(m string) bool {
 	}
 	return false
 }
+
+// Stylesheets and scripts look like any other text and browsers only use them with their type. Files in
+// buckets keep their name, so text gets the type of its extension there
+func MimetypeByExtension(detected string, name string) string {
+	if !strings.HasPrefix(detected, "text/plain") {
+		return detected
+	}
+	if byExtension := mime.TypeByExtension(path.Ext(name)); strings.HasPrefix(byExtension, "text/") {
+		return byExtension
+	}
+	return detected
+}
@@ -0,0 +1,438 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrBucketForbidden = errors.New("this bucket belongs to someone else, send its token in the X-Bucket-Token header")
+var ErrPreconditionFailed = errors.New("the current version of this bucket/alias does not match If-Match or If-None-Match")
+var ErrInvalidBucketName = errors.New("bucket names must be 4 to 64 letters, digits, '.', '_' or '-' and start with a letter or digit")
+var ErrInvalidAlias = errors.New("aliases must be paths like docs/index.html, without empty, '.' or '..' segments")
+
+var bucketNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{3,63}$`)
+
+// Files listed at once when the caller does not choose, and at most
+const (
+	DEFAULT_LISTING_LIMIT = 100
+	MAX_LISTING_LIMIT     = 1000
+)
+
+// Would be shadowed by other routes
+var RESERVED_BUCKET_NAMES = []string{"api", "info", "group", "static", "tokens", "sign", "janitor", "fsck"}
+
+// Longest alias in bytes
+const MAX_ALIAS_LENGTH = 1024
+
+// Served for directories of a bucket, which are listed when they have none
+const DIRECTORY_INDEX = "index.html"
+
+func ValidateBucketName(name string) error {
+	if !bucketNameRe.MatchString(name) {
+		return ErrInvalidBucketName
+	}
+	if slices.Contains(RESERVED_BUCKET_NAMES, name) {
+		return fmt.Errorf("the bucket name '%s' is reserved", name)
+	}
+	return nil
+}
+
+// Aliases are paths of slash separated segments, so files in a bucket can link to each other relatively
+func ValidateAlias(alias string) error {
+	if len(alias) > MAX_ALIAS_LENGTH {
+		return fmt.Errorf("aliases can be at most %d bytes long", MAX_ALIAS_LENGTH)
+	}
+	// Shadowed by the paste view of short names
+	if alias == "p" {
+		return errors.New("the alias 'p' is reserved")
+	}
+	for _, segment := range strings.Split(alias, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidAlias
+		}
+	}
+	return nil
+}
+
+// Whether alias is a directory of a bucket rather than a file. The bucket itself is one too
+func isDirectory(alias string) bool {
+	return alias == "" || strings.HasSuffix(alias, "/")
+}
+
+// Alias of the index of a directory, empty if it has none
+func directoryIndex(bucket string, directory string) (string, error) {
+	alias := directory + DIRECTORY_INDEX
+	_, err := GetDB().findByAlias(bucket, alias, 0)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return alias, err
+}
+
+// Redirects bucket/dir to bucket/dir/ when dir is not a file but has files below it, since directory
+// pages link to their files relatively. Returns whether it redirected
+func redirectToDirectory(c *gin.Context, bucket string, alias string) (bool, error) {
+	db := GetDB()
+	_, err := db.findByAlias(bucket, alias, 0)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	rows, err := db.bucketAliases(bucket, alias+"/", "", true, 1)
+	if err != nil || len(rows) == 0 {
+		return false, err
+	}
+	location := url.PathEscape(path.Base(alias)) + "/"
+	if c.Request.URL.RawQuery != "" {
+		location += "?" + c.Request.URL.RawQuery
+	}
+	c.Redirect(http.StatusMovedPermanently, location)
+	return true, nil
+}
+
+// Escapes every segment of an alias for use in a URL path
+func escapeAlias(alias string) string {
+	segments := strings.Split(alias, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Who is writing to a bucket
+type BucketAccess struct {
+	// User from USERS or USERS_FILE, empty otherwise
+	User string
+	// Bucket token sent with the request
+	Token string
+	// Admins can write to every bucket
+	Admin bool
+}
+
+// Whether access may write to the bucket row belongs to
+func (a BucketAccess) owns(row bucketRow) bool {
+	return a.Admin ||
+		(row.owner != "" && a.User == row.owner) ||
+		(row.tokenHash != "" && checkToken(a.Token, row.tokenHash))
+}
+
+// Checks that access may write to bucket. Buckets nobody claimed yet are claimed for access, bound to its
+// user or to a new bucket token, which is returned. release undoes the claim if the write fails.
+func claimBucket(bucket string, access BucketAccess) (token string, release func(), err error) {
+	db := GetDB()
+	release = func() {}
+	row, err := db.findBucket(bucket)
+	if err == nil {
+		if !access.owns(row) {
+			return "", release, ErrBucketForbidden
+		}
+		return "", release, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", release, err
+	}
+
+	row = bucketRow{name: bucket, owner: access.User}
+	if access.User == "" {
+		token = randomToken()
+		row.tokenHash = hashToken(token)
+	}
+	if err := db.insertBucket(row, time.Now()); err != nil {
+		// Another instance claimed it in the meantime
+		if isUniqueViolation(err) {
+			return claimBucket(bucket, access)
+		}
+		return "", release, err
+	}
+	release = func() {
+		if err := db.deleteBucket(bucket); err != nil {
+			slog.Error("Failed to release bucket", "bucket", bucket, "error", err)
+		}
+	}
+	return token, release, nil
+}
+
+// Whether access belongs to the owner of an existing bucket. Unclaimed buckets have no owner
+func ownsBucket(bucket string, access BucketAccess) (bool, error) {
+	row, err := GetDB().findBucket(bucket)
+	if errors.Is(err, sql.ErrNoRows) {
+		return access.Admin, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return access.owns(row), nil
+}
+
+// Checks whether an upload may replace current, the current version of its alias, or create the alias
+// when there is none. Without overwrite or a precondition existing aliases are never replaced
+func checkAliasWrite(options UploadOptions, current fileRow, exists bool) error {
+	etag := blobETag(current.filename)
+	if options.IfMatch != "" && (!exists || !MatchesETag(options.IfMatch, etag)) {
+		return ErrPreconditionFailed
+	}
+	if options.IfNoneMatch != "" && exists && MatchesETag(options.IfNoneMatch, etag) {
+		return ErrPreconditionFailed
+	}
+	if exists && !options.Overwrite && options.IfMatch == "" && options.IfNoneMatch == "" {
+		return ErrDuplicateAlias
+	}
+	return nil
+}
+
+// Whether the value of an If-Match or If-None-Match header matches an existing file with etag. Weak
+// validators are compared like strong ones since a blob never changes
+func MatchesETag(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || (etag != "" && candidate == etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deletes the versions of bucket/alias that ALIAS_VERSIONS does not keep anymore now that version was uploaded
+func pruneAliasVersions(bucket string, alias string, version int64) {
+	pruned, blobs, err := GetDB().deleteAliasVersionsBefore(bucket, alias, version-int64(GetSettings().AliasVersions)+1)
+	fail := func(format string, args ...any) {
+		slog.Error(fmt.Sprintf(format, args...))
+	}
+	if err != nil {
+		fail("Error deleting old versions of %s/%s: %s", bucket, alias, err)
+	}
+	if pruned > 0 {
+		slog.Info(fmt.Sprintf("Deleted %d old versions of %s/%s", pruned, bucket, alias))
+	}
+	deleteBlobs(blobs, "it was an old version of "+bucket+"/"+alias, fail)
+}
+
+// Hides the listing of bucket from everyone but its owner, or shows it to anyone. Listings are hidden until
+// the owner shows them. Returns sql.ErrNoRows if nobody claimed the bucket
+func SetBucketHidden(bucket string, hidden bool, access BucketAccess) error {
+	db := GetDB()
+	row, err := db.findBucket(bucket)
+	if err != nil {
+		return err
+	}
+	if !access.owns(row) {
+		return ErrBucketForbidden
+	}
+	return db.setBucketHidden(bucket, hidden)
+}
+
+// Current version of an alias in a bucket listing
+type BucketFile struct {
+	Alias string `json:"alias"`
+	// With the extension, like upload URLs
+	Shortname string     `json:"shortname"`
+	Version   int64      `json:"version"`
+	Size      int64      `json:"size,omitempty"`
+	Mimetype  string     `json:"mime,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Size and Mimetype of password protected files are not shown
+	Locked bool `json:"locked,omitempty"`
+}
+
+type BucketListing struct {
+	Bucket string       `json:"bucket"`
+	Files  []BucketFile `json:"files"`
+	// Alias to list the next page after, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// Lists up to limit aliases of bucket starting with prefix, sorted after the alias after. Private files
+// are only listed withPrivate
+func ListBucket(bucket string, prefix string, after string, limit int, withPrivate bool) (BucketListing, error) {
+	listing := BucketListing{Bucket: bucket, Files: []BucketFile{}}
+	// One more tells if there is a next page
+	rows, err := GetDB().bucketAliases(bucket, prefix, after, withPrivate, limit+1)
+	if err != nil {
+		return listing, err
+	}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		listing.Next = rows[limit-1].alias
+	}
+	for _, row := range rows {
+		file := BucketFile{
+			Alias:     row.alias,
+			Shortname: row.shortname + filepath.Ext(row.filename),
+			Version:   row.version,
+			CreatedAt: time.Unix(row.timestamp, 0).UTC(),
+			Locked:    row.passwordHash != "",
+		}
+		if expiry := row.expiry(); !expiry.IsZero() {
+			expiry = expiry.UTC()
+			file.ExpiresAt = &expiry
+		}
+		if !file.Locked {
+			file.Size = row.size
+			file.Mimetype = row.mimetype
+			// Blobs from before mime types were stored are only known by their extension
+			if file.Mimetype == "" {
+				file.Mimetype = mime.TypeByExtension(filepath.Ext(row.alias))
+			}
+			file.Mimetype = MimetypeByExtension(file.Mimetype, row.alias)
+		}
+		listing.Files = append(listing.Files, file)
+	}
+	return listing, nil
+}
+
+// Listing of the bucket in the :name parameter, or of the directory of it in *path, or the status code to fail with
+func listBucket(c *gin.Context) (BucketListing, int, error) {
+	bucket := c.Param("name")
+	directory := strings.TrimPrefix(c.Param("path"), "/")
+	if !isDirectory(directory) {
+		return BucketListing{}, http.StatusNotFound, sql.ErrNoRows
+	}
+	limit := DEFAULT_LISTING_LIMIT
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > MAX_LISTING_LIMIT {
+			return BucketListing{}, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", MAX_LISTING_LIMIT)
+		}
+		limit = n
+	}
+
+	// Buckets from before ownership existed have no row until their next upload, only admins list them
+	row, err := GetDB().findBucket(bucket)
+	claimed := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return BucketListing{}, http.StatusInternalServerError, err
+	}
+	// Hidden buckets look like ones that do not exist
+	if (!claimed || row.hidden) && !getBucketAccess(c).owns(row) {
+		return BucketListing{}, http.StatusNotFound, sql.ErrNoRows
+	}
+
+	after := c.Query("after")
+	listing, err := ListBucket(bucket, directory+c.Query("prefix"), after, limit, canRead(c, true))
+	if err != nil {
+		return listing, http.StatusInternalServerError, err
+	}
+	// Directories only exist while they have files
+	if len(listing.Files) == 0 && after == "" && (!claimed || (directory != "" && c.Query("prefix") == "")) {
+		return listing, http.StatusNotFound, sql.ErrNoRows
+	}
+	return listing, http.StatusOK, nil
+}
+
+// Web page listing a bucket or a directory of it, linking to its files relatively
+func bucketIndexPage(c *gin.Context) {
+	listing, status, err := listBucket(c)
+	if status == http.StatusNotFound {
+		c.HTML(http.StatusNotFound, "404.tmpl", gin.H{})
+		return
+	}
+	if err != nil {
+		c.String(status, err.Error())
+		return
+	}
+
+	type IndexFile struct {
+		Name     string
+		Href     string
+		Size     string
+		Mimetype string
+		Created  string
+		Expires  string
+		Locked   bool
+	}
+	directory := strings.TrimPrefix(c.Param("path"), "/")
+	var indexFiles []IndexFile
+	for _, file := range listing.Files {
+		name := strings.TrimPrefix(file.Alias, directory)
+		indexFile := IndexFile{
+			Name:     name,
+			Href:     "./" + escapeAlias(name),
+			Mimetype: file.Mimetype,
+			Created:  file.CreatedAt.Format("2006-01-02 15:04"),
+			Locked:   file.Locked,
+		}
+		if file.Size > 0 {
+			indexFile.Size = humanReadableSize(file.Size)
+		}
+		if file.ExpiresAt != nil {
+			indexFile.Expires = file.ExpiresAt.Format("2006-01-02 15:04")
+		}
+		indexFiles = append(indexFiles, indexFile)
+	}
+
+	next := ""
+	if listing.Next != "" {
+		query := c.Request.URL.Query()
+		query.Set("after", listing.Next)
+		next = "?" + query.Encode()
+	}
+	c.HTML(http.StatusOK, "bucket.tmpl", gin.H{
+		"title":     GetSettings().AppName,
+		"bucket":    listing.Bucket,
+		"directory": directory,
+		"files":     indexFiles,
+		"prefix":    c.Query("prefix"),
+		"next":      next,
+	})
+}
+
+// Bucket listings at /api/:bucket/ and /api/:bucket/*directory/, and hiding them with PATCH /api/:bucket/
+func addBucketRoutes(api *gin.RouterGroup) {
+	api.GET("/:name/*path", requireListAccess, func(c *gin.Context) {
+		listing, status, err := listBucket(c)
+		if status == http.StatusNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, listing)
+	})
+
+	api.PATCH("/:name/*path", func(c *gin.Context) {
+		if c.Param("path") != "/" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		var request struct {
+			Hidden *bool `json:"hidden"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if request.Hidden == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expected {\"hidden\": true} or {\"hidden\": false}"})
+			return
+		}
+		bucket := c.Param("name")
+		if err := SetBucketHidden(bucket, *request.Hidden, getBucketAccess(c)); err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			case errors.Is(err, ErrBucketForbidden):
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"bucket": bucket, "hidden": *request.Hidden})
+	})
+}
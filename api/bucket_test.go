@@ -0,0 +1,82 @@
+package api_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matheusfillipe/girafiles/api"
+)
+
+func TestValidateBucketName(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"release", "my-bucket_2.0", "0abc", strings.Repeat("a", 64)} {
+		if err := api.ValidateBucketName(name); err != nil {
+			t.Fatalf("Expected '%s' to be valid, got %s", name, err)
+		}
+	}
+	for _, name := range []string{"abc", strings.Repeat("a", 65), ".hidden", "-abc", "with space", "a/b/c/d", "ünïcode", "api", "static", "tokens"} {
+		if err := api.ValidateBucketName(name); err == nil {
+			t.Fatalf("Expected '%s' to be rejected", name)
+		}
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		header  string
+		etag    string
+		matches bool
+	}{
+		{"*", `"abc"`, true},
+		{"*", "", true},
+		{`"abc"`, `"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`"def", "abc"`, `"abc"`, true},
+		{`"def"`, `"abc"`, false},
+		{`""`, "", false},
+	}
+	for _, test := range tests {
+		if api.MatchesETag(test.header, test.etag) != test.matches {
+			t.Fatalf("Expected '%s' matching %s to be %t", test.header, test.etag, test.matches)
+		}
+	}
+}
+
+func TestValidateAlias(t *testing.T) {
+	t.Parallel()
+
+	for _, alias := range []string{"app.tar.gz", "docs/v2/index.html", "a/b/c/d/e", "p/index.html", "...", "with space.txt"} {
+		if err := api.ValidateAlias(alias); err != nil {
+			t.Fatalf("Expected '%s' to be valid, got %s", alias, err)
+		}
+	}
+	for _, alias := range []string{"", "/abs", "dir/", "a//b", "./a", "a/../b", "..", "p", strings.Repeat("a", 1025)} {
+		if err := api.ValidateAlias(alias); err == nil {
+			t.Fatalf("Expected '%s' to be rejected", alias)
+		}
+	}
+}
+
+func TestMimetypeByExtension(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		detected string
+		name     string
+		mimetype string
+	}{
+		{"text/plain; charset=utf-8", "site/style.css", "text/css; charset=utf-8"},
+		{"text/plain; charset=utf-8", "app.js", "text/javascript; charset=utf-8"},
+		{"text/plain; charset=utf-8", "notes", "text/plain; charset=utf-8"},
+		{"text/plain; charset=utf-8", "archive.wasm", "text/plain; charset=utf-8"},
+		{"image/png", "image.css", "image/png"},
+	}
+	for _, test := range tests {
+		if mimetype := api.MimetypeByExtension(test.detected, test.name); mimetype != test.mimetype {
+			t.Fatalf("Expected %s to be served as %s, got %s", test.name, test.mimetype, mimetype)
+		}
+	}
+}
@@ -8,32 +8,39 @@ import (
 	"log"
 	"log/slog"
 	"path/filepath"
-	"slices"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const DUP_ENTRY_ERROR = "UNIQUE constraint failed: files.filename"
-const DUP_ALIAS_ERROR = "UNIQUE constraint failed: files.bucket, files.alias"
+var ErrDuplicateAlias = errors.New("this bucket/alias is already in use, upload with overwrite=true to replace it")
 
-func openDatabase() *sql.DB {
+func openDatabase() *DBHelper {
 	settings := GetSettings()
 
-	db, err := sql.Open("sqlite3", filepath.Join(settings.StorePath, "files.db"))
+	dialect, driver, source, err := databaseSource(settings)
+	if err != nil {
+		log.Fatalf("Error parsing 'DATABASE_URL'. %s", err)
+	}
+	db, err := sql.Open(driver, source)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return db
+	return &DBHelper{DB: db, Dialect: dialect}
 }
 
+// Queries are written for SQLite with ? placeholders and rebound for the other dialects
 type DBHelper struct {
 	*sql.DB
+	// One of DIALECT_*, SQLite if empty
+	Dialect string
 }
 
 var dbLock = &sync.Mutex{}
-var dbInstance *sql.DB
+var dbInstance *DBHelper
 
 func GetDB() *DBHelper {
 	if dbInstance == nil {
@@ -43,269 +50,901 @@ func GetDB() *DBHelper {
 			dbInstance = openDatabase()
 		}
 	}
-	return &DBHelper{dbInstance}
+	return dbInstance
 }
 
-func (db *DBHelper) createTable() {
-	_, err := db.Exec(`
-    CREATE TABLE IF NOT EXISTS files (
+// Implemented by both *DBHelper and *dbTx
+type queryer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Columns of the files table at schema version 1. Frozen, later changes go into migrations
+const LEGACY_FILES_TABLE_COLUMNS = `
         id INTEGER PRIMARY KEY AUTOINCREMENT,
-        filename TEXT NOT NULL UNIQUE,
+        filename TEXT NOT NULL,
         bucket TEXT,
         alias TEXT,
         origin TEXT NOT NULL,
+        timestamp INTEGER NOT NULL,
+        delete_token TEXT,
+        expires_at INTEGER,
+        downloads_left INTEGER,
+        password_hash TEXT,
+        shortname TEXT,
+        original_name TEXT
+`
+
+// Creates and migrates the tables. Must be called before anything else uses the database
+func SetupDatabase() {
+	slog.Debug("Migrating database...")
+	if _, err := GetDB().Migrate(); err != nil {
+		log.Fatalf("Failed to migrate the database: %s", err)
+	}
+	slog.Debug("Done.")
+}
+
+// Databases from before migrations only ran CREATE TABLE IF NOT EXISTS and added columns as they
+// were needed. This brings any of them to schema version 1. Returns whether the blob sizes still
+// have to be filled with fillBlobSizes.
+func adoptLegacySchema(tx *dbTx) (bool, error) {
+	hasBlobs, err := tableExists(tx, DIALECT_SQLITE, "blobs")
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+    CREATE TABLE IF NOT EXISTS blobs (
+        name TEXT PRIMARY KEY,
+        size INTEGER NOT NULL,
+        refcount INTEGER NOT NULL,
         timestamp INTEGER NOT NULL
     );
+  `)
+	if err != nil {
+		return false, err
+	}
+
+	// Columns added after the table was first created
+	for _, column := range [][2]string{
+		{"delete_token", "TEXT"},
+		{"expires_at", "INTEGER"},
+		{"downloads_left", "INTEGER"},
+		{"password_hash", "TEXT"},
+		{"shortname", "TEXT"},
+		{"original_name", "TEXT"},
+	} {
+		if err := addColumnIfMissing(tx, "files", column[0], column[1]); err != nil {
+			return false, err
+		}
+	}
+	if err := fillSequentialShortnames(tx); err != nil {
+		return false, err
+	}
+	if !hasBlobs {
+		if err := migrateToBlobs(tx); err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec(`
     CREATE INDEX IF NOT EXISTS files_origin ON files (origin);
     CREATE INDEX IF NOT EXISTS files_filename ON files (filename);
     CREATE INDEX IF NOT EXISTS files_timestamp ON files (timestamp);
     CREATE INDEX IF NOT EXISTS files_bucket ON files (bucket);
     CREATE INDEX IF NOT EXISTS files_alias ON files (alias);
+    CREATE INDEX IF NOT EXISTS files_expires_at ON files (expires_at);
+    CREATE UNIQUE INDEX IF NOT EXISTS files_shortname ON files (shortname);
   `)
-	if err != nil {
-		log.Fatal(err)
+	return !hasBlobs, err
+}
+
+func tableExists(q queryer, dialect string, table string) (bool, error) {
+	query := "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	if dialect == DIALECT_POSTGRES {
+		query = "SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
 	}
+	var count int
+	err := q.QueryRow(query, table).Scan(&count)
+	return count > 0, err
 }
 
-type HitCounts struct {
-	origin string
-	minute int
-	hour   int
-	day    int
+// Files used to point at blobs through a UNIQUE filename, bucket uploads of an existing blob were
+// stored as {blob}@{n}. The table is rebuilt without the constraint and the suffixes, and every
+// blob gets a reference count.
+func migrateToBlobs(tx *dbTx) error {
+	slog.Info("Moving blobs into their own table")
+
+	// Keep the AUTOINCREMENT counter so short names of deleted files are not handed out again
+	var seq sql.NullInt64
+	if err := tx.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = 'files'").Scan(&seq); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	columns := "id, filename, bucket, alias, origin, timestamp, delete_token, expires_at, downloads_left, password_hash, shortname, original_name"
+	statements := []string{
+		"CREATE TABLE files_new (" + LEGACY_FILES_TABLE_COLUMNS + ")",
+		"INSERT INTO files_new (" + columns + ") SELECT " + strings.Replace(columns, "filename",
+			"CASE WHEN instr(filename, '@') > 0 THEN substr(filename, 1, instr(filename, '@') - 1) ELSE filename END", 1) + " FROM files",
+		"DROP TABLE files",
+		"ALTER TABLE files_new RENAME TO files",
+		"INSERT INTO blobs (name, size, refcount, timestamp) SELECT filename, 0, count(*), min(timestamp) FROM files GROUP BY filename",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if seq.Valid {
+		if _, err := tx.Exec("UPDATE sqlite_sequence SET seq = max(seq, ?) WHERE name = 'files'", seq.Int64); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (db *DBHelper) getHitCounts(origin string) HitCounts {
-	var minute int
-	var hour int
-	var day int
+// Sizes are only known by the storage, so they are filled after migrateToBlobs was committed
+func (db *DBHelper) fillBlobSizes() error {
+	blobs, err := db.Query("SELECT name FROM blobs WHERE size = 0")
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for blobs.Next() {
+		var name string
+		if err := blobs.Scan(&name); err != nil {
+			_ = blobs.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	if err := blobs.Close(); err != nil {
+		return err
+	}
+	for _, name := range names {
+		info, err := GetStorage().Stat(name)
+		if err != nil {
+			slog.Error("Failed to get the size of a blob", "blob", name, "error", err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE blobs SET size = ? WHERE name = ?", info.Size, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	row := db.QueryRow(`
-    SELECT
-        COUNT(CASE WHEN timestamp >= strftime('%s', DATETIME(), '-1 day') THEN 1 END) AS day,
-        COUNT(CASE WHEN timestamp >= strftime('%s', DATETIME(), '-1 hour') THEN 1 END) AS hour,
-        COUNT(CASE WHEN timestamp >= strftime('%s', DATETIME(), '-1 minute') THEN 1 END) AS minute
-    FROM files
-    WHERE origin = ?;
-  `, origin)
+// Rows from before short names were stored were reachable by their sequential short name
+func fillSequentialShortnames(q queryer) error {
+	rows, err := q.Query("SELECT id FROM files WHERE shortname IS NULL")
+	if err != nil {
+		return err
+	}
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
 
-	if err := row.Scan(&day, &hour, &minute); err != nil {
-		log.Fatal(err)
+	for _, id := range ids {
+		if _, err := q.Exec("UPDATE files SET shortname = ? WHERE id = ?", IdxToString(id), id); err != nil {
+			return err
+		}
 	}
-	return HitCounts{origin, minute, hour, day}
+	return nil
 }
 
-func (db *DBHelper) CheckRateLimit(ip string) error {
-	settings := GetSettings()
-	if slices.Contains(settings.RateLimitExcludedIPs, ip) {
+// CREATE TABLE IF NOT EXISTS leaves tables from older versions untouched so new columns
+// have to be added separately
+func addColumnIfMissing(q queryer, table string, column string, definition string) error {
+	rows, err := q.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if name == column {
+			found = true
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+
+	slog.Info(fmt.Sprintf("Adding column %s to table %s", column, table))
+	_, err = q.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+type rateLimitRow struct {
+	limiter  string
+	client   string
+	size     time.Duration
+	start    time.Time
+	current  int
+	previous int
+}
+
+func (db *DBHelper) saveRateLimits(rows []rateLimitRow) error {
+	if len(rows) == 0 {
 		return nil
 	}
-	hits := db.getHitCounts(ip)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, row := range rows {
+		_, err := tx.Exec(`
+      INSERT INTO rate_limits (limiter, client, window_seconds, window_start, current_count, previous_count) VALUES (?, ?, ?, ?, ?, ?)
+      ON CONFLICT (limiter, client, window_seconds) DO UPDATE SET
+        window_start = excluded.window_start, current_count = excluded.current_count, previous_count = excluded.previous_count
+    `, row.limiter, row.client, int64(row.size.Seconds()), row.start.Unix(), row.current, row.previous)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
-	if settings.IPMinRateLimit > 0 && hits.minute >= settings.IPMinRateLimit {
-		return errors.New("rate limit per minute exceeded")
+// Counters whose windows are both over do not limit anything anymore
+func (db *DBHelper) deleteStaleRateLimits(limiter string, now time.Time) error {
+	_, err := db.Exec("DELETE FROM rate_limits WHERE limiter = ? AND window_start + 2 * window_seconds <= ?", limiter, now.Unix())
+	return err
+}
+
+func (db *DBHelper) loadRateLimits(limiter string) ([]rateLimitRow, error) {
+	rows, err := db.Query("SELECT client, window_seconds, window_start, current_count, previous_count FROM rate_limits WHERE limiter = ?", limiter)
+	if err != nil {
+		return nil, err
 	}
-	if settings.IPHourRateLimit > 0 && hits.hour >= settings.IPHourRateLimit {
-		return errors.New("rate limit per hour exceeded")
+	defer func() { _ = rows.Close() }()
+
+	counters := []rateLimitRow{}
+	for rows.Next() {
+		row := rateLimitRow{limiter: limiter}
+		var size, start int64
+		if err := rows.Scan(&row.client, &size, &start, &row.current, &row.previous); err != nil {
+			return nil, err
+		}
+		row.size = time.Duration(size) * time.Second
+		row.start = time.Unix(start, 0)
+		counters = append(counters, row)
 	}
-	if settings.IPDayRateLimit > 0 && hits.day >= settings.IPDayRateLimit {
-		return errors.New("rate limit per day exceeded")
+	return counters, rows.Err()
+}
+
+const API_TOKEN_COLUMNS = "id, name, scopes, created_at, expires_at, last_used_at"
+
+func scanApiToken(row interface{ Scan(...any) error }) (ApiToken, error) {
+	var token ApiToken
+	var scopes string
+	var createdAt int64
+	var expiresAt, lastUsedAt sql.NullInt64
+	if err := row.Scan(&token.ID, &token.Name, &scopes, &createdAt, &expiresAt, &lastUsedAt); err != nil {
+		return token, err
+	}
+	token.Scopes = strings.Split(scopes, ",")
+	token.CreatedAt = time.Unix(createdAt, 0)
+	if expiresAt.Valid {
+		t := time.Unix(expiresAt.Int64, 0)
+		token.ExpiresAt = &t
+	}
+	if lastUsedAt.Valid {
+		t := time.Unix(lastUsedAt.Int64, 0)
+		token.LastUsedAt = &t
+	}
+	return token, nil
+}
+
+func (db *DBHelper) insertApiToken(token *ApiToken, hash string) error {
+	var expiresAt int64
+	if token.ExpiresAt != nil {
+		expiresAt = token.ExpiresAt.Unix()
+	}
+	return db.QueryRow(
+		"INSERT INTO api_tokens (name, token_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?) RETURNING id",
+		token.Name, hash, strings.Join(token.Scopes, ","), token.CreatedAt.Unix(), nullInt(expiresAt),
+	).Scan(&token.ID)
+}
+
+// Token with the hash that did not expire yet
+func (db *DBHelper) findApiToken(hash string, now time.Time) (ApiToken, error) {
+	return scanApiToken(db.QueryRow(
+		"SELECT "+API_TOKEN_COLUMNS+" FROM api_tokens WHERE token_hash = ? AND (expires_at IS NULL OR expires_at > ?)",
+		hash, now.Unix(),
+	))
+}
+
+func (db *DBHelper) apiTokens() ([]ApiToken, error) {
+	rows, err := db.Query("SELECT " + API_TOKEN_COLUMNS + " FROM api_tokens ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	tokens := []ApiToken{}
+	for rows.Next() {
+		token, err := scanApiToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (db *DBHelper) touchApiToken(id int64, now time.Time) error {
+	_, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now.Unix(), id)
+	return err
+}
+
+// Returns sql.ErrNoRows if there is no token with the id
+func (db *DBHelper) deleteApiToken(id int64) error {
+	result, err := db.Exec("DELETE FROM api_tokens WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
 	}
 	return nil
 }
 
 // Modifies node adding shortname to it
 func (db *DBHelper) insertNode(node *Node) error {
-	result, err := db.Exec("INSERT INTO files (filename, origin, timestamp) VALUES (?, ?, ?)", node.name, node.ip, node.timestamp)
+	return db.insertFile(node, sql.NullString{}, sql.NullString{})
+}
+
+// Inserts the row for a node, referencing its blob, and sets its shortname
+func (db *DBHelper) insertFile(node *Node, bucket sql.NullString, alias sql.NullString) error {
+	if err := db.addBlobReference(node.name, node.size, node.mimetype); err != nil {
+		return err
+	}
+	var idx int64
+	err := db.QueryRow(
+		"INSERT INTO files (filename, origin, timestamp, bucket, alias, version, delete_token, expires_at, downloads_left, password_hash, original_name, private) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id",
+		node.name, node.ip, node.timestamp, bucket, alias, nullInt(node.version), hashToken(node.deleteToken), nullInt(node.expiresAt), nullInt(node.maxDownloads), nullString(node.passwordHash), nullString(node.originalName), boolInt(node.private),
+	).Scan(&idx)
 	if err != nil {
+		db.releaseBlobAfterError(node.name)
 		return err
 	}
 
-	idx, err := result.LastInsertId()
+	// Another instance sharing the database can take the same short name between checking and setting it
+	var shortname string
+	for i := 0; i < SHORTNAME_RETRIES; i++ {
+		shortname, err = db.newShortname(idx)
+		if err == nil {
+			_, err = db.Exec("UPDATE files SET shortname = ? WHERE id = ?", shortname, idx)
+		}
+		if !isUniqueViolation(err) {
+			break
+		}
+	}
 	if err != nil {
+		if _, errdb := db.Exec("DELETE FROM files WHERE id = ?", idx); errdb != nil {
+			slog.Error("Failed to delete row without short name", "id", idx, "error", errdb)
+		} else {
+			db.releaseBlobAfterError(node.name)
+		}
 		return err
 	}
-	node.shortname = IdxToString(idx) + node.extension
+	node.shortname = shortname + node.extension
 	return nil
 }
 
-func (db *DBHelper) insertAlias(bucket string, alias string, node *Node) error {
-	// First check if the alias is already in use
-	rows := db.QueryRow("SELECT filename FROM files WHERE bucket = ? AND alias = ?", bucket, alias)
-	var filename string
-	err := rows.Scan(&filename)
-	if err == nil {
-		return errors.New(DUP_ALIAS_ERROR)
-	} else if err != sql.ErrNoRows {
-		return err
+// Random short names are retried this many times when they are already in use
+const SHORTNAME_RETRIES = 10
+
+// Short name for a new row according to SHORTNAME_MODE
+func (db *DBHelper) newShortname(id int64) (string, error) {
+	settings := GetSettings()
+
+	var shortname string
+	switch settings.ShortnameMode {
+	case SHORTNAME_MODE_SEQUENTIAL:
+		shortname = IdxToString(id)
+	case SHORTNAME_MODE_OBFUSCATED:
+		shortname = ObfuscateIdx(id)
+	}
+	// After switching modes the short name of this id can already belong to another row.
+	// Then a random one is used like in random mode.
+	if shortname != "" {
+		taken, err := db.isShortnameTaken(shortname)
+		if err != nil || !taken {
+			return shortname, err
+		}
 	}
 
-	// Then check if the filename is already in use
-	fileCount := 0
-	rows = db.QueryRow("SELECT count(*) FROM files WHERE filename = ?", node.name)
-	err = rows.Scan(&fileCount)
-	if err != nil && err != sql.ErrNoRows {
+	for i := 0; i < SHORTNAME_RETRIES; i++ {
+		shortname = RandomShortname(settings.ShortnameLength)
+		taken, err := db.isShortnameTaken(shortname)
+		if err != nil || !taken {
+			return shortname, err
+		}
+	}
+	return "", fmt.Errorf("failed to find a free short name after %d attempts", SHORTNAME_RETRIES)
+}
+
+func (db *DBHelper) isShortnameTaken(shortname string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM files WHERE shortname = ?", shortname).Scan(&count)
+	return count > 0, err
+}
+
+// Inserts node as the next version of bucket/alias and sets node.version. Returns ErrDuplicateAlias
+// if another instance inserted the same version in the meantime
+func (db *DBHelper) insertAlias(bucket string, alias string, node *Node) error {
+	// Expired versions the janitor did not delete yet still hold their number
+	var latest sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM files WHERE bucket = ? AND alias = ?", bucket, alias).Scan(&latest); err != nil {
 		return err
 	}
+	node.version = latest.Int64 + 1
 
-	// If the filename is already in use, we insert it as {filename}@{count} just to avoid constraint errors
-	if fileCount > 0 {
-		node.name = fmt.Sprintf("%s@%d", node.name, fileCount)
+	err := db.insertFile(node, sql.NullString{String: bucket, Valid: true}, sql.NullString{String: alias, Valid: true})
+	if isUniqueViolation(err) {
+		return ErrDuplicateAlias
 	}
+	return err
+}
 
-	// Now we can insert the alias
-	result, err := db.Exec("INSERT INTO files (filename, origin, timestamp, bucket, alias) VALUES (?, ?, ?, ?, ?)", node.name, node.ip, node.timestamp, bucket, alias)
+// Deletes the versions of bucket/alias older than version. Returns how many were deleted and the blobs
+// that are not referenced anymore
+func (db *DBHelper) deleteAliasVersionsBefore(bucket string, alias string, version int64) (int, []string, error) {
+	return db.deleteFileRows("bucket = ? AND alias = ? AND version < ?", bucket, alias, version)
+}
+
+type bucketRow struct {
+	name string
+	// User that claimed the bucket, empty if it was claimed with a token
+	owner     string
+	tokenHash string
+	// Only the owner can list the bucket
+	hidden bool
+}
+
+func (db *DBHelper) findBucket(name string) (bucketRow, error) {
+	row := bucketRow{name: name}
+	var owner, tokenHash sql.NullString
+	err := db.QueryRow("SELECT owner, token_hash, hidden FROM buckets WHERE name = ?", name).Scan(&owner, &tokenHash, &row.hidden)
+	row.owner, row.tokenHash = owner.String, tokenHash.String
+	return row, err
+}
+
+// Returns sql.ErrNoRows if nobody claimed the bucket
+func (db *DBHelper) setBucketHidden(name string, hidden bool) error {
+	result, err := db.Exec("UPDATE buckets SET hidden = ? WHERE name = ?", boolInt(hidden), name)
 	if err != nil {
 		return err
 	}
-	idx, err := result.LastInsertId()
+	updated, err := result.RowsAffected()
+	if err == nil && updated == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// Current versions of the aliases in bucket starting with prefix and sorted after the alias after, at most limit
+// of them. Private files are left out unless withPrivate is set
+func (db *DBHelper) bucketAliases(bucket string, prefix string, after string, withPrivate bool, limit int) ([]listedFileRow, error) {
+	query := "SELECT " + FILE_ROW_COLUMNS + ", " +
+		"(SELECT COALESCE(MAX(size), 0) FROM blobs WHERE blobs.name = files.filename), " +
+		"(SELECT MAX(mimetype) FROM blobs WHERE blobs.name = files.filename) " +
+		"FROM files WHERE bucket = ? AND alias > ? AND SUBSTR(alias, 1, ?) = ? AND " + notExpiredCondition() +
+		" AND version = (SELECT MAX(version) FROM files AS latest WHERE latest.bucket = files.bucket AND latest.alias = files.alias AND " + notExpiredCondition() + ")"
+	if !withPrivate {
+		query += " AND private = 0"
+	}
+	rows, err := db.Query(query+" ORDER BY alias LIMIT ?", bucket, after, utf8.RuneCountInString(prefix), prefix, limit)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	node.shortname = IdxToString(idx) + node.extension
-	return nil
+	defer func() { _ = rows.Close() }()
+
+	files := []listedFileRow{}
+	for rows.Next() {
+		var file listedFileRow
+		var mimetype sql.NullString
+		file.fileRow, err = scanFileRow(extraColumns{rows, []any{&file.size, &mimetype}})
+		if err != nil {
+			return nil, err
+		}
+		file.mimetype = mimetype.String
+		files = append(files, file)
+	}
+	return files, rows.Err()
 }
 
-func (db *DBHelper) checkShortName(name string) (string, error) {
+// Fails with a unique violation if somebody claimed the bucket first
+func (db *DBHelper) insertBucket(row bucketRow, now time.Time) error {
+	// Only the owner lists a new bucket
+	_, err := db.Exec("INSERT INTO buckets (name, owner, token_hash, created_at, hidden) VALUES (?, ?, ?, ?, 1)",
+		row.name, nullString(row.owner), nullString(row.tokenHash), now.Unix())
+	return err
+}
+
+func (db *DBHelper) deleteBucket(name string) error {
+	_, err := db.Exec("DELETE FROM buckets WHERE name = ?", name)
+	return err
+}
+
+// Zero is stored as NULL
+func nullInt(n int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: n, Valid: n != 0}
+}
+
+// Flags are stored as 0 or 1 in INTEGER columns
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Empty strings are stored as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Downloads left of files that can be downloaded any number of times
+const UNLIMITED_DOWNLOADS = -1
+
+type fileRow struct {
+	id            int64
+	filename      string
+	timestamp     int64
+	expiresAt     int64
+	deleteToken   string
+	downloadsLeft int64
+	passwordHash  string
+	// Empty for files uploaded before original names were stored
+	originalName string
+	private      bool
+	// Of bucket aliases, empty and zero for other files
+	alias   string
+	version int64
+	// Without the extension
+	shortname string
+}
+
+// When the file will be deleted, zero if never
+func (r fileRow) expiry() time.Time {
+	if r.expiresAt != 0 {
+		return time.Unix(r.expiresAt, 0)
+	}
+	if hours := GetSettings().FilePersistanceTime; hours > 0 {
+		return time.Unix(r.timestamp, 0).Add(time.Duration(hours) * time.Hour)
+	}
+	return time.Time{}
+}
+
+const FILE_ROW_COLUMNS = "id, filename, timestamp, expires_at, delete_token, downloads_left, password_hash, original_name, private, alias, version, shortname"
+
+// Expired files are hidden even if the janitor did not delete them yet
+func notExpiredCondition() string {
+	return "NOT (" + expiredCondition() + ")"
+}
+
+// Scans the columns selected after FILE_ROW_COLUMNS into extra
+type extraColumns struct {
+	row   interface{ Scan(...any) error }
+	extra []any
+}
+
+func (e extraColumns) Scan(dest ...any) error {
+	return e.row.Scan(append(dest, e.extra...)...)
+}
+
+// File row of a bucket listing with what the listing shows of its blob
+type listedFileRow struct {
+	fileRow
+	size int64
+	// Empty for blobs uploaded before mime types were stored
+	mimetype string
+}
+
+func scanFileRow(row interface{ Scan(...any) error }) (fileRow, error) {
+	var r fileRow
+	var expiresAt sql.NullInt64
+	var deleteToken sql.NullString
+	var downloadsLeft sql.NullInt64
+	var passwordHash sql.NullString
+	var originalName sql.NullString
+	var alias, shortname sql.NullString
+	var version sql.NullInt64
+	err := row.Scan(&r.id, &r.filename, &r.timestamp, &expiresAt, &deleteToken, &downloadsLeft, &passwordHash, &originalName, &r.private, &alias, &version, &shortname)
+	r.alias, r.version, r.shortname = alias.String, version.Int64, shortname.String
+	r.expiresAt = expiresAt.Int64
+	r.originalName = originalName.String
+	r.deleteToken = deleteToken.String
+	r.passwordHash = passwordHash.String
+	r.downloadsLeft = UNLIMITED_DOWNLOADS
+	if downloadsLeft.Valid {
+		r.downloadsLeft = downloadsLeft.Int64
+	}
+	return r, err
+}
+
+func (db *DBHelper) findByShortName(name string) (fileRow, error) {
 	// remove the extension from the filename
 	name = strings.TrimSuffix(name, filepath.Ext(name))
 
-	var path string
-	index, err := StringToIdx(name)
+	// Every row stores its short name so links keep working whatever SHORTNAME_MODE was used
+	return scanFileRow(db.QueryRow("SELECT "+FILE_ROW_COLUMNS+" FROM files WHERE shortname = ? AND "+notExpiredCondition(), name))
+}
+
+// Finds a version of bucket/alias, the latest one that did not expire if version is zero
+func (db *DBHelper) findByAlias(bucket string, alias string, version int64) (fileRow, error) {
+	if version != 0 {
+		return scanFileRow(db.QueryRow("SELECT "+FILE_ROW_COLUMNS+" FROM files WHERE bucket = ? AND alias = ? AND version = ? AND "+notExpiredCondition(), bucket, alias, version))
+	}
+	return scanFileRow(db.QueryRow("SELECT "+FILE_ROW_COLUMNS+" FROM files WHERE bucket = ? AND alias = ? AND "+notExpiredCondition()+" ORDER BY version DESC LIMIT 1", bucket, alias))
+}
+
+// Atomically takes one download from a row with limited downloads. Returns how many are left
+// or sql.ErrNoRows if there were none left.
+func (db *DBHelper) decrementDownloads(id int64) (int64, error) {
+	var left int64
+	err := db.QueryRow("UPDATE files SET downloads_left = downloads_left - 1 WHERE id = ? AND downloads_left > 0 RETURNING downloads_left", id).Scan(&left)
+	return left, err
+}
+
+// Deletes a row and drops its blob reference. Returns the blob and whether it is not referenced
+// anymore, in which case it should be deleted from the storage.
+func (db *DBHelper) deleteFileRow(id int64) (string, bool, error) {
+	var blob string
+	if err := db.QueryRow("DELETE FROM files WHERE id = ? RETURNING filename", id).Scan(&blob); err != nil {
+		return "", false, err
+	}
+	unused, err := db.releaseBlob(blob)
+	return blob, unused, err
+}
+
+// Size of every blob in bytes, kept up to date by the blob reference counting
+func (db *DBHelper) totalBlobSize() (int64, error) {
+	var size int64
+	err := db.QueryRow("SELECT CAST(COALESCE(SUM(size), 0) AS BIGINT) FROM blobs").Scan(&size)
+	return size, err
+}
+
+// Counts one more row pointing at a blob, creating it if this is the first one
+func (db *DBHelper) addBlobReference(blob string, size int64, mimetype string) error {
+	_, err := db.Exec(`
+    INSERT INTO blobs (name, size, refcount, timestamp, mimetype) VALUES (?, ?, 1, ?, ?)
+    ON CONFLICT (name) DO UPDATE SET refcount = blobs.refcount + 1, mimetype = COALESCE(blobs.mimetype, excluded.mimetype)
+  `, blob, size, time.Now().Unix(), nullString(mimetype))
+	return err
+}
+
+// Whether any row references a blob
+func (db *DBHelper) isBlobReferenced(blob string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM blobs WHERE name = ?", blob).Scan(&count)
+	return count > 0, err
+}
+
+// Size and mime type of a blob, the mime type is empty for blobs uploaded before mime types were stored
+func (db *DBHelper) blobInfo(blob string) (int64, string, error) {
+	var size int64
+	var mimetype sql.NullString
+	err := db.QueryRow("SELECT size, mimetype FROM blobs WHERE name = ?", blob).Scan(&size, &mimetype)
+	return size, mimetype.String, err
+}
+
+// Drops one reference to a blob. Returns true when it was the last one, the blob row is removed then
+// and the caller has to delete it from the storage.
+func (db *DBHelper) releaseBlob(blob string) (bool, error) {
+	var refcount int64
+	err := db.QueryRow("UPDATE blobs SET refcount = refcount - 1 WHERE name = ? RETURNING refcount", blob).Scan(&refcount)
+	if err == sql.ErrNoRows {
+		slog.Warn("Released a blob that is not tracked", "blob", blob)
+		return false, nil
+	}
+	if err != nil || refcount > 0 {
+		return false, err
+	}
+	if _, err := db.Exec("DELETE FROM blobs WHERE name = ?", blob); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Undoes addBlobReference when the row could not be inserted. The caller deletes the blob if it created it.
+func (db *DBHelper) releaseBlobAfterError(blob string) {
+	if _, err := db.releaseBlob(blob); err != nil {
+		slog.Error("Failed to release blob", "blob", blob, "error", err)
+	}
+}
+
+type blobRow struct {
+	name     string
+	size     int64
+	refcount int64
+}
+
+func (db *DBHelper) blobRows() ([]blobRow, error) {
+	rows, err := db.Query("SELECT name, size, refcount FROM blobs")
 	if err != nil {
-		return "", fmt.Errorf("failed to short filename")
+		return nil, err
 	}
-	row := db.QueryRow("SELECT filename FROM files WHERE id = ?", index)
-	if err := row.Scan(&path); err != nil {
-		return "", err
+	defer func() { _ = rows.Close() }()
+
+	blobs := []blobRow{}
+	for rows.Next() {
+		var blob blobRow
+		if err := rows.Scan(&blob.name, &blob.size, &blob.refcount); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
 	}
-	return path, nil
+	return blobs, rows.Err()
 }
 
-func (db *DBHelper) getShortnameForFilename(filename string) (string, error) {
-	var idx int64
-	var dbFilename string
-	row := db.QueryRow("SELECT id, filename FROM files WHERE filename = ?", filename)
-	if err := row.Scan(&idx, &dbFilename); err != nil {
-		slog.Debug(fmt.Sprintf("Failed to get shortname for filename %s", filename))
-		return "", err
+// Short names of the rows pointing at each blob
+func (db *DBHelper) blobReferences() (map[string][]string, error) {
+	rows, err := db.Query("SELECT filename, COALESCE(shortname, '') FROM files ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	references := map[string][]string{}
+	for rows.Next() {
+		var blob, shortname string
+		if err := rows.Scan(&blob, &shortname); err != nil {
+			return nil, err
+		}
+		references[blob] = append(references[blob], shortname)
+	}
+	return references, rows.Err()
+}
+
+// Creates or overwrites a blob row. Only meant for repairs, uploads count references with addBlobReference
+func (db *DBHelper) setBlob(blob string, size int64, refcount int64) error {
+	_, err := db.Exec(`
+    INSERT INTO blobs (name, size, refcount, timestamp) VALUES (?, ?, ?, ?)
+    ON CONFLICT (name) DO UPDATE SET size = excluded.size, refcount = excluded.refcount
+  `, blob, size, refcount, time.Now().Unix())
+	return err
+}
+
+// Deletes a blob row together with every row pointing at it. Returns how many rows were deleted
+func (db *DBHelper) forgetBlob(blob string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	result, err := tx.Exec("DELETE FROM files WHERE filename = ?", blob)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM blobs WHERE name = ?", blob); err != nil {
+		return 0, err
 	}
-	shortname := IdxToString(idx)
-	ext := filepath.Ext(dbFilename)
-	return shortname + ext, nil
+	return deleted, tx.Commit()
 }
 
-func (db *DBHelper) checkAlias(bucket string, alias string) (string, error) {
-	var path string
-	row := db.QueryRow("SELECT filename FROM files WHERE bucket = ? AND alias = ?", bucket, alias)
-	if err := row.Scan(&path); err != nil {
-		return "", err
+// Deletes rows matching condition. Returns how many were deleted and the blobs that are not referenced anymore
+func (db *DBHelper) deleteFileRows(condition string, args ...any) (int, []string, error) {
+	rows, err := db.Query("DELETE FROM files WHERE "+condition+" RETURNING filename", args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	var released []string
+	for rows.Next() {
+		var blob string
+		if err := rows.Scan(&blob); err != nil {
+			_ = rows.Close()
+			return 0, nil, err
+		}
+		released = append(released, blob)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, nil, err
+	}
+
+	var unusedBlobs []string
+	for _, blob := range released {
+		unused, err := db.releaseBlob(blob)
+		if err != nil {
+			return len(released), unusedBlobs, err
+		}
+		if unused {
+			unusedBlobs = append(unusedBlobs, blob)
+		}
 	}
-	return path, nil
+	return len(released), unusedBlobs, nil
 }
 
-func (db *DBHelper) deleteExpiredFiles() ([]string, error) {
+// SQL condition matching expired rows. Rows with an explicit expiry use it, the others expire
+// FILE_PERSISTANCE_TIME hours after being uploaded. The current time is taken from Go so every
+// dialect agrees on it.
+func expiredCondition() string {
 	settings := GetSettings()
-	if settings.FilePersistanceTime == 0 {
-		slog.Debug("File persistance time is unlimited")
-		return []string{}, nil
+	now := time.Now().Unix()
+	condition := fmt.Sprintf("(expires_at IS NOT NULL AND expires_at <= %d)", now)
+	if settings.FilePersistanceTime > 0 {
+		condition += fmt.Sprintf(" OR (expires_at IS NULL AND timestamp <= %d)", now-int64(settings.FilePersistanceTime)*60*60)
 	}
+	return condition
+}
+
+// Returns how many files expired and the blobs that are not referenced anymore
+func (db *DBHelper) deleteExpiredFiles() (int, []string, error) {
+	condition := expiredCondition()
 
 	// Just debugging
 	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
-		query := fmt.Sprintf(`
-      SELECT filename,
-        timestamp <= strftime('%%s', DATETIME(), '-%d hour') AS expired,
-        timestamp || '(db)' || ' <= ' || strftime('%%s', DATETIME(), '-%d hour')
-      FROM files
-    `,
-			settings.FilePersistanceTime,
-			settings.FilePersistanceTime,
-		)
-		rows, err := db.Query(query)
+		rows, err := db.Query(fmt.Sprintf("SELECT filename, %s AS expired, timestamp, expires_at FROM files", condition))
 		if err != nil {
-			return nil, err
+			return 0, nil, err
 		}
-		defer func() {
-			if err := rows.Close(); err != nil {
-				slog.Error("Failed to close rows", "error", err)
-			}
-		}()
 
 		var results []map[string]string
 		for rows.Next() {
 			var filename string
 			var expired bool
-			var reason string
-			if err := rows.Scan(&filename, &expired, &reason); err != nil {
-				return nil, err
+			var timestamp int64
+			var expiresAt sql.NullInt64
+			if err := rows.Scan(&filename, &expired, &timestamp, &expiresAt); err != nil {
+				_ = rows.Close()
+				return 0, nil, err
+			}
+			expiry := "default"
+			if expiresAt.Valid {
+				expiry = fmt.Sprint(expiresAt.Int64)
 			}
 			results = append(results, map[string]string{
 				"filename": filename,
 				"expired":  fmt.Sprintf("%t", expired),
-				"reason":   reason,
+				"reason":   fmt.Sprintf("%d(db) expires at %s, now %d", timestamp, expiry, time.Now().Unix()),
 			})
 		}
-		slog.Debug(fmt.Sprintf("Files and their expiration status: %v", results))
-	}
-
-	query := fmt.Sprintf("SELECT filename FROM files WHERE timestamp <= strftime('%%s', DATETIME(), '-%d hour')", settings.FilePersistanceTime)
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
 		if err := rows.Close(); err != nil {
-			slog.Error("Failed to close rows", "error", err)
-		}
-	}()
-
-	var files []string
-	for rows.Next() {
-		var filename string
-		if err := rows.Scan(&filename); err != nil {
-			return nil, err
+			return 0, nil, err
 		}
-		files = append(files, filename)
+		slog.Debug(fmt.Sprintf("Files and their expiration status: %v", results))
 	}
 
-	query = fmt.Sprintf("DELETE FROM files WHERE timestamp <= strftime('%%s', DATETIME(), '-%d hour')", settings.FilePersistanceTime)
-	_, err = db.Exec(query)
-	if err != nil {
-		return nil, err
-	}
-	return files, nil
+	return db.deleteFileRows(condition)
 }
 
-func (db *DBHelper) deleteOldestFiles(n int) ([]string, error) {
+// Returns how many files were deleted and the blobs that are not referenced anymore, which may be
+// none if the files shared them
+func (db *DBHelper) deleteOldestFiles(n int) (int, []string, error) {
 	settings := GetSettings()
 	if settings.StorePathSizeLimit == 0 {
-		return []string{}, nil
-	}
-
-	rows, err := db.Query("SELECT filename FROM files ORDER BY timestamp ASC LIMIT ?", n)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			slog.Error("Failed to close rows", "error", err)
-		}
-	}()
-
-	_, err = db.Exec("DELETE FROM files WHERE id IN (SELECT id FROM files ORDER BY timestamp ASC LIMIT ?)", n)
-	if err != nil {
-		return nil, err
-	}
-	var files []string
-	for rows.Next() {
-		var filename string
-		if err := rows.Scan(&filename); err != nil {
-			return nil, err
-		}
-		files = append(files, filename)
+		return 0, []string{}, nil
 	}
 
-	return files, nil
+	return db.deleteFileRows("id IN (SELECT id FROM files ORDER BY timestamp ASC LIMIT ?)", n)
 }
 
 // / Update the timestamp of a file setting it to the current time
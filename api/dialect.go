@@ -0,0 +1,117 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	DIALECT_SQLITE   = "sqlite"
+	DIALECT_POSTGRES = "postgres"
+)
+
+// SQLSTATE of unique_violation
+const POSTGRES_UNIQUE_VIOLATION = "23505"
+
+// Picks the database from DATABASE_URL. Returns the dialect, the database/sql driver and its data source.
+// Without DATABASE_URL a SQLite database in STORE_PATH is used.
+func databaseSource(settings *Settings) (string, string, string, error) {
+	url := settings.DatabaseURL
+	switch {
+	case url == "":
+		return DIALECT_SQLITE, "sqlite3", filepath.Join(settings.StorePath, "files.db"), nil
+	case strings.HasPrefix(url, "sqlite://"):
+		return DIALECT_SQLITE, "sqlite3", strings.TrimPrefix(url, "sqlite://"), nil
+	case strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+		return DIALECT_POSTGRES, "pgx", url, nil
+	}
+	return "", "", "", fmt.Errorf("expected a sqlite:// or postgres:// url")
+}
+
+// Queries are written with ? placeholders, Postgres wants $1, $2, ...
+func rebind(dialect string, query string) string {
+	if dialect != DIALECT_POSTGRES || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Whether err was caused by a UNIQUE constraint or primary key
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == POSTGRES_UNIQUE_VIOLATION
+	}
+	return false
+}
+
+func (db *DBHelper) dialect() string {
+	if db.Dialect == "" {
+		return DIALECT_SQLITE
+	}
+	return db.Dialect
+}
+
+func (db *DBHelper) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(rebind(db.dialect(), query), args...)
+}
+
+func (db *DBHelper) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(rebind(db.dialect(), query), args...)
+}
+
+func (db *DBHelper) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(rebind(db.dialect(), query), args...)
+}
+
+func (db *DBHelper) Begin() (*dbTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{Tx: tx, dialect: db.dialect()}, nil
+}
+
+// Transaction that rebinds its queries like DBHelper
+type dbTx struct {
+	*sql.Tx
+	dialect string
+}
+
+func (tx *dbTx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(rebind(tx.dialect, query), args...)
+}
+
+func (tx *dbTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(rebind(tx.dialect, query), args...)
+}
+
+func (tx *dbTx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(rebind(tx.dialect, query), args...)
+}
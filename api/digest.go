@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DIGEST_SHA256 = "sha-256"
+	// Blobs uploaded before SHA-256 was used are named after their MD5
+	DIGEST_MD5 = "md5"
+)
+
+// Blobs are named {hex digest}[-{n}]{extension}. The -{n} suffix is only used when a different
+// content with the same digest was already stored.
+func blobDigest(name string) (string, []byte, bool) {
+	hash := strings.TrimSuffix(name, filepath.Ext(name))
+	if i := strings.IndexByte(hash, '-'); i >= 0 {
+		hash = hash[:i]
+	}
+	sum, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", nil, false
+	}
+	switch len(sum) {
+	case sha256.Size:
+		return DIGEST_SHA256, sum, true
+	case md5.Size:
+		return DIGEST_MD5, sum, true
+	}
+	return "", nil, false
+}
+
+// Quoted ETag of a blob, empty if its name is not a digest
+func blobETag(name string) string {
+	_, sum, ok := blobDigest(name)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("\"%x\"", sum)
+}
+
+// Compares a stored blob with a local file byte for byte
+func sameContent(storage Storage, name string, path string, size int64) (bool, error) {
+	stored, info, err := storage.Get(name)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = stored.Close() }()
+	if info.Size != size {
+		return false, nil
+	}
+
+	local, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = local.Close() }()
+
+	a := make([]byte, 32*1024)
+	b := make([]byte, 32*1024)
+	for {
+		n, errA := io.ReadFull(stored, a)
+		m, errB := io.ReadFull(local, b)
+		if n != m || !bytes.Equal(a[:n], b[:m]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// Hashes a stored blob with the algorithm its name was computed with
+func storedDigest(storage Storage, name string, algorithm string) ([]byte, error) {
+	var h hash.Hash
+	switch algorithm {
+	case DIGEST_SHA256:
+		h = sha256.New()
+	case DIGEST_MD5:
+		h = md5.New()
+	default:
+		return nil, fmt.Errorf("unknown digest algorithm '%s'", algorithm)
+	}
+
+	stored, _, err := storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = stored.Close() }()
+	if _, err := io.Copy(h, stored); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var expiryDurationRe = regexp.MustCompile(`^(\d+)\s*([smhdw])$`)
+
+var expiryUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+type expiryOption struct {
+	Value    string
+	Label    string
+	duration time.Duration
+}
+
+// Choices offered in the web UI
+var expiryChoices = []expiryOption{
+	{"10m", "10 minutes", 10 * time.Minute},
+	{"1h", "1 hour", time.Hour},
+	{"6h", "6 hours", 6 * time.Hour},
+	{"1d", "1 day", 24 * time.Hour},
+	{"7d", "7 days", 7 * 24 * time.Hour},
+	{"30d", "30 days", 30 * 24 * time.Hour},
+}
+
+// Parses a relative duration like 10m, 6h, 7d, 2w (or anything time.ParseDuration accepts)
+// or an absolute RFC 3339 time into the moment the file should expire.
+func ParseExpiry(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	var expires time.Time
+	if match := expiryDurationRe.FindStringSubmatch(value); match != nil {
+		n, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expiry '%s'", value)
+		}
+		expires = now.Add(time.Duration(n) * expiryUnits[match[2]])
+	} else if d, err := time.ParseDuration(value); err == nil {
+		expires = now.Add(d)
+	} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+		expires = t
+	} else {
+		return time.Time{}, fmt.Errorf("invalid expiry '%s'. Use a duration like 10m, 6h, 7d or an RFC 3339 time", value)
+	}
+
+	if !expires.After(now) {
+		return time.Time{}, fmt.Errorf("expiry '%s' is not in the future", value)
+	}
+	return expires, nil
+}
+
+// Applies the server side maximum to a requested expiry
+func capExpiry(expires time.Time, now time.Time) time.Time {
+	max := GetSettings().MaxPersistance()
+	if max > 0 && expires.Sub(now) > max {
+		return now.Add(max)
+	}
+	return expires
+}
+
+// Expiry choices that are allowed by the server side maximum
+func expiryOptions() []expiryOption {
+	max := GetSettings().MaxPersistance()
+	options := []expiryOption{}
+	for _, option := range expiryChoices {
+		if max == 0 || option.duration <= max {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+func humanReadableDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+
+	units := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+
+	// Only show the two most significant units
+	parts := []string{}
+	for _, unit := range units {
+		if len(parts) == 2 {
+			break
+		}
+		n := d / unit.duration
+		if n == 0 {
+			if len(parts) > 0 {
+				break
+			}
+			continue
+		}
+		d -= n * unit.duration
+		if n == 1 {
+			parts = append(parts, fmt.Sprintf("1 %s", unit.name))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d %ss", n, unit.name))
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,37 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matheusfillipe/girafiles/api"
+)
+
+func TestParseExpiry(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	valid := map[string]time.Time{
+		"10m":                  now.Add(10 * time.Minute),
+		"6h":                   now.Add(6 * time.Hour),
+		"7d":                   now.Add(7 * 24 * time.Hour),
+		"2w":                   now.Add(14 * 24 * time.Hour),
+		"1h30m":                now.Add(90 * time.Minute),
+		"2024-01-02T12:00:00Z": now.Add(24 * time.Hour),
+	}
+	for value, expected := range valid {
+		got, err := api.ParseExpiry(value, now)
+		if err != nil {
+			t.Fatalf("Expected %q to be valid, got %s", value, err)
+		}
+		if !got.Equal(expected) {
+			t.Fatalf("Expected %q to expire at %s, got %s", value, expected, got)
+		}
+	}
+
+	for _, value := range []string{"", "tomorrow", "-5m", "0h", "2023-12-31T12:00:00Z", "5y"} {
+		if _, err := api.ParseExpiry(value, now); err == nil {
+			t.Fatalf("Expected %q to be invalid", value)
+		}
+	}
+}
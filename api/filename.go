@@ -1,7 +1,9 @@
 package api
 
 import (
+	"crypto/rand"
 	"math"
+	"math/big"
 
 	"github.com/jxskiss/base62"
 )
@@ -30,3 +32,51 @@ func StringToIdx(s string) (int64, error) {
 	}
 	return output - int64(offset), nil
 }
+
+const (
+	SHORTNAME_MODE_SEQUENTIAL = "sequential"
+	SHORTNAME_MODE_RANDOM     = "random"
+	SHORTNAME_MODE_OBFUSCATED = "obfuscated"
+
+	BASE62_ALPHABET = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// Obfuscated short names are an affine permutation a*x+b of the ids with the same length, so they
+// stay as short as sequential ones. The multiplier is a prime coprime with the size of every
+// length block (61*62^n). This only hides the order of uploads, use random short names to make
+// them unguessable.
+var (
+	obfuscateMultiplier = big.NewInt(1580030173)
+	obfuscateIncrement  = big.NewInt(625341585)
+)
+
+// First value and number of values of the base62 numbers with the same length as v
+func lengthBlock(v int64) (*big.Int, *big.Int) {
+	length := len(base62.FormatInt(v))
+	low := new(big.Int).Exp(big.NewInt(62), big.NewInt(int64(length-1)), nil)
+	size := new(big.Int).Mul(low, big.NewInt(61))
+	return low, size
+}
+
+// / Convert index to a non sequential alphanumeric string of the same length as IdxToString
+func ObfuscateIdx(i int64) string {
+	v := i + getOffset()
+	low, size := lengthBlock(v)
+	x := new(big.Int).Sub(big.NewInt(v), low)
+	x.Mul(x, obfuscateMultiplier).Add(x, obfuscateIncrement).Mod(x, size)
+	return string(base62.FormatInt(x.Add(x, low).Int64()))
+}
+
+// Random alphanumeric string
+func RandomShortname(length int) string {
+	max := big.NewInt(int64(len(BASE62_ALPHABET)))
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = BASE62_ALPHABET[n.Int64()]
+	}
+	return string(b)
+}
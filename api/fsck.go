@@ -0,0 +1,283 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// In the storage but no file points at it
+	FSCK_ORPHAN_BLOB = "orphan_blob"
+	// Files point at it but it is not in the storage
+	FSCK_MISSING_BLOB = "missing_blob"
+	// In the storage and referenced by files but not in the blobs table
+	FSCK_UNTRACKED_BLOB    = "untracked_blob"
+	FSCK_REFCOUNT_MISMATCH = "refcount_mismatch"
+	FSCK_SIZE_MISMATCH     = "size_mismatch"
+	// The contents do not match the digest the blob is named after
+	FSCK_HASH_MISMATCH = "hash_mismatch"
+)
+
+// Objects younger than this are not reported as orphans since they may belong to an upload that is
+// not in the database yet, possibly from another process
+const FSCK_GRACE_PERIOD = time.Minute
+
+type FsckOptions struct {
+	// Fix the problems found. Files whose contents are missing or corrupted are deleted
+	Repair bool
+	// Only hash blobs with a size mismatch instead of every blob
+	SkipHash bool
+}
+
+type FsckProblem struct {
+	Kind   string `json:"kind"`
+	Blob   string `json:"blob"`
+	Detail string `json:"detail"`
+	// Short names of the files pointing at the blob
+	Files    []string `json:"files,omitempty"`
+	Repaired bool     `json:"repaired"`
+}
+
+type FsckReport struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  string        `json:"duration"`
+	Repair    bool          `json:"repair"`
+	Objects   int           `json:"objects"`
+	Blobs     int           `json:"blobs"`
+	Files     int           `json:"files"`
+	Problems  []FsckProblem `json:"problems"`
+	Errors    []string      `json:"errors,omitempty"`
+}
+
+// Problems that are still there after the run
+func (r FsckReport) Unrepaired() int {
+	n := 0
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+type fsck struct {
+	options FsckOptions
+	report  *FsckReport
+	storage Storage
+	db      *DBHelper
+	// Digests computed before taking storageLock, by object name
+	digests map[string]objectDigest
+}
+
+// Digest of an object as it was when it was hashed
+type objectDigest struct {
+	object ObjectInfo
+	sum    []byte
+}
+
+func (f *fsck) fail(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	slog.Error(message)
+	f.report.Errors = append(f.report.Errors, message)
+}
+
+// Records a problem and runs repair for it in repair mode
+func (f *fsck) problem(kind string, blob string, files []string, repair func() error, format string, args ...any) {
+	problem := FsckProblem{Kind: kind, Blob: blob, Detail: fmt.Sprintf(format, args...), Files: files}
+	if f.options.Repair {
+		if err := repair(); err != nil {
+			f.fail("Error repairing %s %s: %s", kind, blob, err)
+		} else {
+			problem.Repaired = true
+			slog.Info(fmt.Sprintf("Repaired %s %s: %s", kind, blob, problem.Detail))
+		}
+	}
+	f.report.Problems = append(f.report.Problems, problem)
+}
+
+// Deletes the files pointing at a blob, its row and its contents
+func (f *fsck) forget(blob string) error {
+	if _, err := f.db.forgetBlob(blob); err != nil {
+		return err
+	}
+	_, err := deleteUnusedBlob(blob)
+	return err
+}
+
+// Hashes every object named after a digest without holding storageLock, reading them takes long.
+// Objects that are deleted meanwhile are skipped, checkContent hashes what is missing.
+func (f *fsck) hashObjects() {
+	objects, err := f.storage.List()
+	if err != nil {
+		return
+	}
+	for _, object := range objects {
+		algorithm, _, ok := blobDigest(object.Name)
+		if !ok {
+			continue
+		}
+		if sum, err := storedDigest(f.storage, object.Name, algorithm); err == nil {
+			f.digests[object.Name] = objectDigest{object: object, sum: sum}
+		}
+	}
+}
+
+// Digest of object, from hashObjects unless it changed since
+func (f *fsck) digest(object ObjectInfo, algorithm string) ([]byte, error) {
+	if digest, ok := f.digests[object.Name]; ok && digest.object.Size == object.Size && digest.object.ModTime.Equal(object.ModTime) {
+		return digest.sum, nil
+	}
+	return storedDigest(f.storage, object.Name, algorithm)
+}
+
+// Compares the database with the storage. Blobs are hashed first, then uploads and the janitor wait
+// until the database and the storage were compared and repaired.
+func Fsck(options FsckOptions) (report FsckReport) {
+	report.StartedAt = time.Now().UTC()
+	report.Repair = options.Repair
+	report.Problems = []FsckProblem{}
+	defer func() { report.Duration = time.Since(report.StartedAt).String() }()
+
+	f := &fsck{options: options, report: &report, storage: GetStorage(), db: GetDB(), digests: map[string]objectDigest{}}
+	if !options.SkipHash {
+		f.hashObjects()
+	}
+
+	storageLock.Lock()
+	defer storageLock.Unlock()
+
+	objects, err := f.storage.List()
+	if err != nil {
+		f.fail("Error listing the storage: %s", err)
+		return report
+	}
+	blobs, err := f.db.blobRows()
+	if err != nil {
+		f.fail("Error reading blobs: %s", err)
+		return report
+	}
+	references, err := f.db.blobReferences()
+	if err != nil {
+		f.fail("Error reading files: %s", err)
+		return report
+	}
+
+	report.Objects = len(objects)
+	report.Blobs = len(blobs)
+	stored := map[string]ObjectInfo{}
+	for _, object := range objects {
+		stored[object.Name] = object
+	}
+	tracked := map[string]bool{}
+	for _, files := range references {
+		report.Files += len(files)
+	}
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].name < blobs[j].name })
+	for _, blob := range blobs {
+		tracked[blob.name] = true
+		f.checkBlob(blob, references[blob.name], stored)
+	}
+
+	// Rows pointing at blobs the blobs table does not know about
+	untracked := []string{}
+	for name := range references {
+		if !tracked[name] {
+			untracked = append(untracked, name)
+		}
+	}
+	sort.Strings(untracked)
+	for _, name := range untracked {
+		files := references[name]
+		tracked[name] = true
+		object, exists := stored[name]
+		if !exists {
+			f.problem(FSCK_MISSING_BLOB, name, files, func() error { return f.forget(name) },
+				"%d files point at it but it is neither in the storage nor in the blobs table", len(files))
+			continue
+		}
+		f.problem(FSCK_UNTRACKED_BLOB, name, files, func() error { return f.db.setBlob(name, object.Size, int64(len(files))) },
+			"%d files point at it but it is not in the blobs table", len(files))
+		f.checkContent(blobRow{name: name, size: object.Size, refcount: int64(len(files))}, files, object)
+	}
+
+	for _, object := range objects {
+		if tracked[object.Name] || pendingBlobs[object.Name] > 0 || time.Since(object.ModTime) < FSCK_GRACE_PERIOD {
+			continue
+		}
+		f.problem(FSCK_ORPHAN_BLOB, object.Name, nil, func() error { return f.storage.Delete(object.Name) },
+			"%s in the storage that no file points at", humanReadableSize(object.Size))
+	}
+
+	slog.Info(fmt.Sprintf("fsck checked %d objects, %d blobs and %d files: %d problems, %d not repaired",
+		report.Objects, report.Blobs, report.Files, len(report.Problems), report.Unrepaired()))
+	return report
+}
+
+func (f *fsck) checkBlob(blob blobRow, files []string, stored map[string]ObjectInfo) {
+	object, exists := stored[blob.name]
+	if !exists {
+		if len(files) == 0 {
+			f.problem(FSCK_MISSING_BLOB, blob.name, nil, func() error { return f.forget(blob.name) },
+				"in the blobs table but neither in the storage nor used by any file")
+		} else {
+			f.problem(FSCK_MISSING_BLOB, blob.name, files, func() error { return f.forget(blob.name) },
+				"%d files point at it but it is not in the storage", len(files))
+		}
+		return
+	}
+	if len(files) == 0 {
+		f.problem(FSCK_ORPHAN_BLOB, blob.name, nil, func() error { return f.forget(blob.name) },
+			"in the blobs table with refcount %d but no file points at it", blob.refcount)
+		return
+	}
+
+	if !f.checkContent(blob, files, object) {
+		return
+	}
+	if blob.refcount != int64(len(files)) {
+		f.problem(FSCK_REFCOUNT_MISMATCH, blob.name, files, func() error { return f.db.setBlob(blob.name, object.Size, int64(len(files))) },
+			"refcount is %d but %d files point at it", blob.refcount, len(files))
+	}
+}
+
+// Hashes the blob if required and compares its size. Returns false if it was found to be corrupted
+func (f *fsck) checkContent(blob blobRow, files []string, object ObjectInfo) bool {
+	sizeMismatch := blob.size != object.Size
+	if !f.options.SkipHash || sizeMismatch {
+		if algorithm, expected, ok := blobDigest(blob.name); ok {
+			actual, err := f.digest(object, algorithm)
+			if err != nil {
+				f.fail("Error hashing %s: %s", blob.name, err)
+				return true
+			}
+			if !bytes.Equal(expected, actual) {
+				f.problem(FSCK_HASH_MISMATCH, blob.name, files, func() error { return f.forget(blob.name) },
+					"contents do not match the %s digest it is named after (%s in the storage)", algorithm, humanReadableSize(object.Size))
+				return false
+			}
+		}
+	}
+
+	if sizeMismatch {
+		f.problem(FSCK_SIZE_MISMATCH, blob.name, files, func() error { return f.db.setBlob(blob.name, object.Size, int64(len(files))) },
+			"the blobs table says %d bytes but the storage has %d", blob.size, object.Size)
+	}
+	return true
+}
+
+// One line per problem, for the command line
+func (p FsckProblem) String() string {
+	line := fmt.Sprintf("%s %s: %s", p.Kind, p.Blob, p.Detail)
+	if len(p.Files) > 0 {
+		line += fmt.Sprintf(" [%s]", strings.Join(p.Files, ", "))
+	}
+	if p.Repaired {
+		line += " (repaired)"
+	}
+	return line
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// What the last janitor run did
+type JanitorResult struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+	// Rows deleted because they expired
+	Expired int `json:"expired"`
+	// Rows deleted to get under STORE_PATH_SIZE_LOW_WATER
+	Evicted int `json:"evicted"`
+	// Blobs deleted from the storage because nothing referenced them anymore
+	DeletedBlobs int   `json:"deleted_blobs"`
+	FreedBytes   int64 `json:"freed_bytes"`
+	// Size of the storage after the run
+	StorageBytes int64    `json:"storage_bytes"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+var janitorLock = &sync.Mutex{}
+var lastJanitorResult *JanitorResult
+var janitorKick = make(chan struct{}, 1)
+
+// Result of the last janitor run, nil if it did not run yet
+func LastJanitorResult() *JanitorResult {
+	janitorLock.Lock()
+	defer janitorLock.Unlock()
+	return lastJanitorResult
+}
+
+// Asks the janitor to run soon, e.g. after an upload. Never blocks.
+func KickJanitor() {
+	select {
+	case janitorKick <- struct{}{}:
+	default:
+	}
+}
+
+// Runs the janitor every JANITOR_INTERVAL seconds and whenever it is kicked
+func StartJanitor() {
+	settings := GetSettings()
+	var tick <-chan time.Time
+	if settings.JanitorInterval > 0 {
+		ticker := time.NewTicker(time.Duration(settings.JanitorInterval) * time.Second)
+		tick = ticker.C
+	}
+
+	go func() {
+		for {
+			runJanitor()
+			select {
+			case <-tick:
+			case <-janitorKick:
+			}
+		}
+	}()
+}
+
+func runJanitor() {
+	result := janitor()
+	janitorLock.Lock()
+	lastJanitorResult = &result
+	janitorLock.Unlock()
+}
+
+// Deletes expired files, then the oldest ones until the storage is under the low water mark
+func janitor() (result JanitorResult) {
+	storageLock.Lock()
+	defer storageLock.Unlock()
+
+	result.StartedAt = time.Now().UTC()
+	defer func() { result.Duration = time.Since(result.StartedAt).String() }()
+
+	settings := GetSettings()
+	db := GetDB()
+	fail := func(format string, args ...any) {
+		message := fmt.Sprintf(format, args...)
+		slog.Error(message)
+		result.Errors = append(result.Errors, message)
+	}
+
+	sizeBefore, err := db.totalBlobSize()
+	if err != nil {
+		fail("Error computing storage size: %s", err)
+		return result
+	}
+
+	expired, blobs, err := db.deleteExpiredFiles()
+	if err != nil {
+		fail("Error deleting expired files: %s", err)
+	}
+	result.Expired = expired
+	result.DeletedBlobs += deleteBlobs(blobs, "it expired", fail)
+
+	size, err := db.totalBlobSize()
+	if err != nil {
+		fail("Error computing storage size: %s", err)
+		return result
+	}
+
+	limit := int64(settings.StorePathSizeLimit) * 1024 * 1024
+	lowWater := int64(settings.StorePathSizeLowWaterMark()) * 1024 * 1024
+	if settings.IsStorePathSizeLimitEnabled() && size > limit {
+		slog.Info(fmt.Sprintf("Storage size %s exceeds the limit of %s", humanReadableSize(size), humanReadableSize(limit)))
+		for size > lowWater {
+			evicted, blobs, err := db.deleteOldestFiles(1)
+			if err != nil {
+				fail("Error deleting oldest files from database: %s", err)
+				break
+			}
+			if evicted == 0 {
+				break
+			}
+			result.Evicted += evicted
+			result.DeletedBlobs += deleteBlobs(blobs, "storage limit was exceeded", fail)
+			if size, err = db.totalBlobSize(); err != nil {
+				fail("Error computing storage size: %s", err)
+				return result
+			}
+		}
+	}
+
+	result.StorageBytes = size
+	result.FreedBytes = sizeBefore - size
+	return result
+}
+
+// Deletes unreferenced blobs from the storage. Returns how many were deleted
+func deleteBlobs(blobs []string, reason string, fail func(string, ...any)) int {
+	deleted := 0
+	for _, blob := range blobs {
+		ok, err := deleteUnusedBlob(blob)
+		if err != nil {
+			fail("Error deleting file %s: %s", blob, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		deleted++
+		slog.Info(fmt.Sprintf("Deleted file %s because %s", blob, reason))
+	}
+	return deleted
+}
@@ -1,13 +1,22 @@
 package api
 
 import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,6 +24,9 @@ import (
 const (
 	CONTENT_TYPE_JSON = "application/json"
 	CONTENT_TYPE_TEXT = "text/plain"
+
+	// Maximum size of a non file form field in multipart uploads
+	MAX_FORM_VALUE_SIZE = 64 * 1024
 )
 
 func formatIntUnlimitedIf0(number int) string {
@@ -37,18 +49,78 @@ func getHostUrl(request *http.Request) string {
 	return fmt.Sprintf("%s://%s", proto, request.Host)
 }
 
+// Accepts the credentials of a user in USERS or an API token
 func checkAuth(c *gin.Context) bool {
-	users := GetSettings().Users
-	gin.BasicAuth(gin.Accounts(users))(c)
-	if c.IsAborted() {
-		if strings.HasPrefix(c.Request.URL.Path, "/api/") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		}
+	if getCredentials(c) == nil {
+		abortUnauthorized(c)
 		return false
 	}
 	return true
 }
 
+func abortUnauthorized(c *gin.Context) {
+	if abortAuthRateLimited(c) {
+		return
+	}
+	c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+	if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+// Checks basic auth credentials against USERS and USERS_FILE without aborting the request
+func basicAuthUser(c *gin.Context) (string, bool) {
+	user, password, ok := c.Request.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	if expected, exists := GetSettings().Users[user]; exists {
+		return user, subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	}
+	if users := GetUsersFile(); users != nil {
+		return user, users.Authenticate(user, password)
+	}
+	return user, false
+}
+
+// Deletion token from the X-Delete-Token header or the token query parameter
+func getDeleteToken(c *gin.Context) string {
+	if token := c.GetHeader("X-Delete-Token"); token != "" {
+		return token
+	}
+	return c.Query("token")
+}
+
+// Users write to the buckets they claimed, anyone else needs the bucket token. Admin tokens write anywhere
+func getBucketAccess(c *gin.Context) BucketAccess {
+	access := BucketAccess{Token: c.GetHeader("X-Bucket-Token")}
+	if credentials := getCredentials(c); credentials != nil {
+		access.User = credentials.user
+		access.Admin = credentials.token != nil && credentials.token.HasScope(SCOPE_ADMIN)
+	}
+	return access
+}
+
+func handleDelete(c *gin.Context, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows), os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		case errors.Is(err, ErrInvalidDeleteToken):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "File deleted",
+	})
+}
+
 type FileParams interface {
 	GetName() string
 }
@@ -63,37 +135,214 @@ func (f File) GetName() string {
 
 type FileBucket struct {
 	Bucket string `uri:"name" binding:"required"`
-	Name   string `uri:"alias" binding:"required"`
+	// Alias with a leading slash
+	Path string `uri:"path" binding:"required"`
+}
+
+// Path in the bucket, empty for the bucket itself
+func (fb FileBucket) Alias() string {
+	return strings.TrimPrefix(fb.Path, "/")
 }
 
 // GetName implements FileRequest.
 func (fb FileBucket) GetName() string {
-	return fb.Name
+	return fb.Alias()
 }
 
-func handleUpload(c *gin.Context, filename string, err error, params url.Values, contentType string) {
-	url := fmt.Sprintf("%s/%s", getHostUrl(c.Request), filename)
-	if err != nil {
-		if err.Error() == DUP_ENTRY_ERROR {
-			if params.Get("redirect") == "true" {
-				slog.Debug(fmt.Sprintf("Redirecting to %s", url))
-				c.Redirect(http.StatusFound, url)
-				return
-			}
-			if contentType == CONTENT_TYPE_JSON {
-				c.JSON(http.StatusOK, gin.H{
-					"status":  "success",
-					"message": "File already exists",
-					"url":     url,
-				})
-			} else {
-				c.String(http.StatusOK, "File already exists: %s", url)
-			}
+// Points the *path parameter at another alias for the handlers after this call
+func setAliasParam(c *gin.Context, alias string) {
+	for i := range c.Params {
+		if c.Params[i].Key == "path" {
+			c.Params[i].Value = "/" + alias
+		}
+	}
+}
+
+// Runs handlers like a route would, until one of them aborts
+func runHandlers(c *gin.Context, handlers ...gin.HandlerFunc) {
+	for _, handler := range handlers {
+		if c.IsAborted() {
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		handler(c)
+	}
+}
+
+// Maps upload errors to the HTTP status code they should be reported with
+func uploadErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrFileTooLarge), errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrFileEmpty), errors.Is(err, http.ErrMissingFile), errors.Is(err, http.ErrNotMultipart):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrBucketForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrDuplicateAlias):
+		return http.StatusConflict
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
+// Streams the "file" part of a multipart request into STORE_PATH without buffering it in memory.
+// The remaining form fields are returned as well.
+func receiveMultipartFile(c *gin.Context) (*IncomingFile, string, url.Values, error) {
+	form := url.Values{}
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, "", form, err
+	}
+
+	var file *IncomingFile
+	var filename string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Discard()
+			return nil, "", form, err
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" && file == nil {
+			filename = part.FileName()
+			file, err = ReceiveFile(part)
+		} else {
+			var value []byte
+			value, err = io.ReadAll(io.LimitReader(part, MAX_FORM_VALUE_SIZE))
+			form.Add(part.FormName(), string(value))
+		}
+		if cerr := part.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			file.Discard()
+			return nil, "", form, err
+		}
+	}
+
+	if file == nil {
+		return nil, "", form, http.ErrMissingFile
+	}
+	return file, filename, form, nil
+}
+
+// Upload options can be given as query parameters, X-Girafiles-* headers or multipart form fields
+func uploadParam(c *gin.Context, form url.Values, name string) string {
+	if value := c.Query(name); value != "" {
+		return value
+	}
+	if value := c.GetHeader("X-Girafiles-" + name); value != "" {
+		return value
+	}
+	return form.Get(name)
+}
+
+func parseUploadOptions(c *gin.Context, form url.Values) (UploadOptions, error) {
+	var options UploadOptions
+	if expires := uploadParam(c, form, "expires"); expires != "" {
+		expiresAt, err := ParseExpiry(expires, time.Now())
+		if err != nil {
+			return options, err
+		}
+		options.ExpiresAt = expiresAt
+	}
+	if maxDownloads := uploadParam(c, form, "max_downloads"); maxDownloads != "" {
+		n, err := strconv.ParseInt(maxDownloads, 10, 64)
+		if err != nil || n < 1 {
+			return options, fmt.Errorf("max_downloads must be a positive integer")
+		}
+		options.MaxDownloads = n
+	}
+	if uploadParam(c, form, "burn") == "true" {
+		options.MaxDownloads = 1
+	}
+	options.Password = uploadParam(c, form, "password")
+	options.Private = uploadParam(c, form, "private") == "true"
+	options.Overwrite = uploadParam(c, form, "overwrite") == "true"
+	options.IfMatch = c.GetHeader("If-Match")
+	options.IfNoneMatch = c.GetHeader("If-None-Match")
+	return options, nil
+}
+
+// Version of a bucket alias asked for with ?version=N, zero for the current one
+func aliasVersion(c *gin.Context) (int64, error) {
+	value := c.Query("version")
+	if value == "" {
+		return 0, nil
+	}
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version < 1 {
+		return 0, errors.New("version must be a positive integer")
+	}
+	return version, nil
+}
+
+// Password of a protected file from the X-Girafiles-Password header, the password query
+// parameter or the unlock form
+func getPassword(c *gin.Context) string {
+	if password := c.GetHeader("X-Girafiles-Password"); password != "" {
+		return password
+	}
+	if password := c.Query("password"); password != "" {
+		return password
+	}
+	if c.Request.Method == http.MethodPost {
+		return c.PostForm("password")
+	}
+	return ""
+}
+
+// Tokens with the read-private scope do not need the password. Wrong passwords count as failed
+// authentication attempts, once there were too many they are not checked anymore
+func unlockFile(c *gin.Context, file fileResponse) error {
+	if credentials := getCredentials(c); credentials != nil && credentials.token != nil && credentials.token.HasScope(SCOPE_READ_PRIVATE) {
+		return nil
+	}
+	password := getPassword(c)
+	if !file.locked() || password == "" {
+		return file.unlock(password)
+	}
+	allowed, done := allowAuthAttempt(c)
+	if !allowed {
+		return ErrWrongPassword
+	}
+	err := file.unlock(password)
+	done(err == nil)
+	return err
+}
+
+// Browsers get the unlock page, API clients a JSON error. Clients that guessed wrong too often get a 429
+func requestPassword(c *gin.Context, err error) {
+	if abortAuthRateLimited(c) {
 		return
 	}
+	if strings.Contains(c.GetHeader("Accept"), "text/html") {
+		wrong := errors.Is(err, ErrWrongPassword)
+		c.HTML(http.StatusUnauthorized, "unlock.tmpl", gin.H{
+			"title": GetSettings().AppName,
+			"wrong": wrong,
+		})
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+}
+
+func handleUpload(c *gin.Context, result UploadResult, err error, params url.Values, contentType string) {
+	url := fmt.Sprintf("%s/%s", getHostUrl(c.Request), result.Shortname)
+	if err != nil {
+		c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// Also sent as a header so plain text clients can read it
+	c.Header("X-Delete-Token", result.DeleteToken)
+	if result.BucketToken != "" {
+		c.Header("X-Bucket-Token", result.BucketToken)
+	}
 
 	if params.Get("redirect") == "true" {
 		slog.Debug(fmt.Sprintf("Redirecting to %s", url))
@@ -102,10 +351,27 @@ func handleUpload(c *gin.Context, filename string, err error, params url.Values,
 	}
 
 	if contentType == CONTENT_TYPE_JSON {
-		c.JSON(http.StatusOK, gin.H{
-			"status": "success",
-			"url":    url,
-		})
+		response := gin.H{
+			"status":       "success",
+			"url":          url,
+			"delete_token": result.DeleteToken,
+		}
+		if !result.ExpiresAt.IsZero() {
+			response["expires_at"] = result.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		if result.MaxDownloads > 0 {
+			response["max_downloads"] = result.MaxDownloads
+		}
+		if result.Private {
+			response["private"] = true
+		}
+		if result.BucketToken != "" {
+			response["bucket_token"] = result.BucketToken
+		}
+		if result.Version > 0 {
+			response["version"] = result.Version
+		}
+		c.JSON(http.StatusOK, response)
 	} else {
 		c.String(http.StatusOK, url)
 	}
@@ -115,24 +381,69 @@ func handleUpload(c *gin.Context, filename string, err error, params url.Values,
 func setCORSHeaders(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", "*")
 	c.Header("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-	c.Header("Access-Control-Expose-Headers", "Content-Type, Content-Length")
+	c.Header("Access-Control-Expose-Headers", "Content-Type, Content-Length, Content-Range, Accept-Ranges, ETag, Digest, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset")
 }
 
-func deliverHead(c *gin.Context, err error, mime string, size int64) {
+// Characters that can be left unencoded in RFC 5987 values
+const RFC5987_ATTR_CHARS = "!#$&+-.^_`|~"
+
+// Content-Disposition with an ASCII filename for old clients and the real one in filename*
+func contentDisposition(disposition string, filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || unicode.IsControl(r) || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	var encoded strings.Builder
+	for _, b := range []byte(filename) {
+		if b < unicode.MaxASCII && (unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b)) || strings.IndexByte(RFC5987_ATTR_CHARS, b) >= 0) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback, encoded.String())
+}
+
+// The content digest is part of the blob name, so it is sent without reading the file
+func setDigestHeaders(c *gin.Context, blob string) {
+	algorithm, sum, ok := blobDigest(blob)
+	if !ok {
+		return
+	}
+	c.Header("ETag", blobETag(blob))
+	c.Header("Digest", algorithm+"="+base64.StdEncoding.EncodeToString(sum))
+}
+
+func deliverHead(c *gin.Context, err error, info FileInfo) {
 	if err != nil {
 		if os.IsNotExist(err) || strings.Contains(err.Error(), "no rows in result") {
 			c.Status(http.StatusNotFound)
 			return
 		}
+		if errors.Is(err, ErrPasswordRequired) {
+			c.Status(http.StatusUnauthorized)
+			return
+		}
 		c.Status(http.StatusInternalServerError)
 		return
 	}
 	setCORSHeaders(c)
-	c.Header("Content-Type", mime)
-	c.Header("Content-Length", fmt.Sprintf("%d", size))
+	setDigestHeaders(c, info.blob)
+	c.Header("Content-Type", info.Mimetype)
+	c.Header("Content-Length", fmt.Sprintf("%d", info.Size))
+	c.Header("Accept-Ranges", "bytes")
 	c.Status(http.StatusOK)
 }
 
+// Whether the request uses up one of the downloads of a limited file, every GET does including ranges
+func countsAsDownload(r *http.Request) bool {
+	return r.Method != http.MethodHead
+}
+
+// Streams the file from disk. Range, If-Range and conditional requests are handled by http.ServeContent
 func deliverFile(c *gin.Context, err error, file fileResponse, download bool) {
 	if err != nil {
 		if os.IsNotExist(err) || strings.Contains(err.Error(), "no rows in result") {
@@ -140,53 +451,112 @@ func deliverFile(c *gin.Context, err error, file fileResponse, download bool) {
 			return
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Not deferred directly, consume may mark the file to be deleted on close
+	defer func() { file.Close() }()
+
+	if err := unlockFile(c, file); err != nil {
+		requestPassword(c, err)
+		return
 	}
+	// The info page would not know the password, unlocked files are downloaded right away
+	if file.locked() && !isSupportedMimetype(file.mimetype) {
+		download = true
+	}
+
+	if isSupportedMimetype(file.mimetype) || download {
+		if countsAsDownload(c.Request) {
+			if err := file.consume(); err != nil {
+				deliverFile(c, err, fileResponse{}, download)
+				return
+			}
+		}
+		if file.limited() {
+			c.Header("Cache-Control", "no-store")
+		}
+	}
+
 	// If mime type is supported to be displayed in the browser, display it.
 	// otherwise, download it.
 	if isSupportedMimetype(file.mimetype) && !download {
 		setCORSHeaders(c)
-		c.Data(http.StatusOK, file.mimetype, file.content)
+		setDigestHeaders(c, file.name)
+		c.Header("Content-Disposition", contentDisposition("inline", file.downloadName()))
+		c.Header("Content-Type", file.mimetype)
+		http.ServeContent(c.Writer, c.Request, file.name, file.modtime, file.content)
 		return
 	} else if download {
 		setCORSHeaders(c)
-		c.Header("Content-Disposition", "attachment; filename="+file.name)
-		c.Data(http.StatusOK, file.mimetype, file.content)
+		setDigestHeaders(c, file.name)
+		c.Header("Content-Disposition", contentDisposition("attachment", file.downloadName()))
+		c.Header("Content-Type", file.mimetype)
+		http.ServeContent(c.Writer, c.Request, file.name, file.modtime, file.content)
 	} else {
 		c.Redirect(308, fmt.Sprintf("/info/%s", file.shortname))
 	}
 }
+
 func postFile(contentType string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		file, err := c.FormFile("file")
+		file, filename, form, err := receiveMultipartFile(c)
+		if err != nil {
+			c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		options, err := parseUploadOptions(c, form)
 		if err != nil {
+			file.Discard()
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
 		params := c.Request.URL.Query()
-		n, err := Upload(file, c.ClientIP())
+		n, err := Upload(file, filename, c.ClientIP(), options)
 		handleUpload(c, n, err, params, contentType)
 	}
 }
 
+// Warns once when a request comes with X-Forwarded-For but TRUSTED_PROXY_IP is not set. The header is ignored
+// then, so behind a proxy every client has the IP of the proxy and shares its rate limits
+func warnForwardedWithoutProxies() gin.HandlerFunc {
+	var once sync.Once
+	return func(c *gin.Context) {
+		if c.GetHeader("X-Forwarded-For") != "" {
+			once.Do(func() {
+				slog.Warn("Got a request with X-Forwarded-For but TRUSTED_PROXY_IP is not set, clients are identified by the IP of the proxy", "ip", c.ClientIP())
+			})
+		}
+		c.Next()
+	}
+}
+
 func StartServer() {
 	var settings = GetSettings()
 
-	slog.Debug("Creating database Tables...")
-	GetDB().createTable()
-	slog.Debug("Done.")
+	SetupDatabase()
+	StartJanitor()
+	limitUploads, limitDownloads := startRateLimiters()
 
 	router := gin.Default()
 	router.RemoveExtraSlash = true
 	router.LoadHTMLGlob("web/templates/*")
 	router.Static("/static", "web/static")
-	if settings.TrustedProxyIP != "" {
-		if err := router.SetTrustedProxies([]string{settings.TrustedProxyIP}); err != nil {
+	if len(settings.TrustedProxies) > 0 {
+		proxies := []string{}
+		for _, prefix := range settings.TrustedProxies {
+			proxies = append(proxies, prefix.String())
+		}
+		if err := router.SetTrustedProxies(proxies); err != nil {
 			panic(err)
 		}
 		router.RemoteIPHeaders = []string{"X-Forwarded-For", "X-Real-Ip"}
-		router.TrustedPlatform = settings.TrustedProxyIP
 		router.ForwardedByClientIP = true
+	} else {
+		if err := router.SetTrustedProxies(nil); err != nil {
+			panic(err)
+		}
+		router.Use(warnForwardedWithoutProxies())
 	}
 
 	api := router.Group("/api")
@@ -202,20 +572,36 @@ func StartServer() {
 	})
 
 	api.Use(func(c *gin.Context) {
-		// Log the request headers
-		fmt.Printf("Request Headers: %v", c.Request.Header)
-		if settings.IsAuthEnabled() {
+		// Deletions can also be authorized by the deletion token, the handlers check the credentials
+		if settings.IsAuthEnabled() && c.Request.Method != http.MethodDelete {
 			checkAuth(c)
 		}
 		c.Next()
-		go func() {
-			<-c.Request.Context().Done()
-			cleanup()
-		}()
 	})
 
-	api.POST("/", postFile(CONTENT_TYPE_JSON))
-	files.POST("/", func(c *gin.Context) {
+	api.POST("/", requireScope(SCOPE_UPLOAD), limitUploads, postFile(CONTENT_TYPE_JSON))
+	// Reports what the janitor deleted, only to admins
+	api.GET("/janitor", requireScope(SCOPE_ADMIN), func(c *gin.Context) {
+		result := LastJanitorResult()
+		if result == nil {
+			c.JSON(http.StatusOK, gin.H{"status": "not run yet"})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+	// Repairs can delete files so this needs an admin
+	fsck := func(repair bool) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			report := Fsck(FsckOptions{Repair: repair, SkipHash: c.Query("skip_hash") == "true"})
+			c.JSON(http.StatusOK, report)
+		}
+	}
+	api.GET("/fsck", requireScope(SCOPE_ADMIN), fsck(false))
+	api.POST("/fsck", requireScope(SCOPE_ADMIN), fsck(true))
+	addTokenRoutes(api.Group("/tokens", requireApiToken, requireScope(SCOPE_ADMIN)))
+	addSigningRoutes(api.Group("/sign", requireReadPrivate))
+	addBucketRoutes(api)
+	files.POST("/", requireScope(SCOPE_UPLOAD), limitUploads, func(c *gin.Context) {
 		if settings.IsAuthEnabled() {
 			if !checkAuth(c) {
 				return
@@ -224,7 +610,7 @@ func StartServer() {
 		postFile(CONTENT_TYPE_TEXT)(c)
 	})
 
-	api.PUT("/:name/:alias", func(c *gin.Context) {
+	api.PUT("/:name/*path", requireScope(SCOPE_UPLOAD), limitUploads, func(c *gin.Context) {
 		var fb FileBucket
 		if err := c.ShouldBindUri(&fb); err != nil {
 			slog.Error(fmt.Sprintf("Failed to upload file: %s", err.Error()))
@@ -232,33 +618,86 @@ func StartServer() {
 			return
 		}
 
-		if len(fb.Bucket) > 64 || len(fb.Bucket) < 4 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Bucket name must be between 4 and 64 characters"})
+		if err := ValidateBucketName(fb.Bucket); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := ValidateAlias(fb.Alias()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		options, err := parseUploadOptions(c, url.Values{})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
 		// Receive file as request content
-		reader := c.Request.Body
+		file, err := ReceiveFile(c.Request.Body)
+		if err != nil {
+			c.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
 		params := c.Request.URL.Query()
-		n, err := UploadToBucket(reader, c.ClientIP(), fb.Bucket, fb.Name)
+		n, err := UploadToBucket(file, c.ClientIP(), fb.Bucket, fb.Alias(), options, getBucketAccess(c))
 		handleUpload(c, n, err, params, CONTENT_TYPE_JSON)
 	})
-	files.GET("/info/:name", func(c *gin.Context) {
+	api.DELETE("/:name", func(c *gin.Context) {
 		var f File
 		if err := c.ShouldBindUri(&f); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err})
 			return
 		}
-		file, err := Download(f.Name)
+		err := Delete(f.Name, getDeleteToken(c), hasScope(c, SCOPE_DELETE))
+		handleDelete(c, err)
+	})
+	api.DELETE("/:name/*path", func(c *gin.Context) {
+		var fb FileBucket
+		if err := c.ShouldBindUri(&fb); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err})
+			return
+		}
+		version, err := aliasVersion(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		owner, err := ownsBucket(fb.Bucket, getBucketAccess(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		err = DeleteFromBucket(fb.Bucket, fb.Alias(), version, getDeleteToken(c), owner || hasScope(c, SCOPE_DELETE))
+		handleDelete(c, err)
+	})
+
+	files.GET("/info/:name", requireReadAccess, func(c *gin.Context) {
+		var f File
+		if err := c.ShouldBindUri(&f); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err})
+			return
+		}
+		info, err := GetFileInfo(f.Name)
 		if err != nil {
 			c.HTML(http.StatusNotFound, "404.tmpl", gin.H{})
+			return
+		}
+		expires := ""
+		if !info.ExpiresAt.IsZero() {
+			expires = humanReadableDuration(time.Until(info.ExpiresAt))
 		}
 		c.HTML(http.StatusOK, "info.tmpl", gin.H{
-			"title": settings.AppName,
-			"size":  humanReadableSize(len(file.content)),
+			"title":         settings.AppName,
+			"size":          humanReadableSize(info.Size),
+			"locked":        info.Locked,
+			"originalName":  info.OriginalName,
+			"expires":       expires,
+			"limited":       info.DownloadsLeft != UNLIMITED_DOWNLOADS,
+			"downloadsLeft": info.DownloadsLeft,
 		})
 	})
-	files.GET("/:name", func(c *gin.Context) {
+	getFile := func(c *gin.Context) {
 		var f File
 		if err := c.ShouldBindUri(&f); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err})
@@ -266,7 +705,10 @@ func StartServer() {
 		}
 		file, err := Download(f.Name)
 		deliverFile(c, err, file, c.Request.URL.Query().Get("download") != "")
-	})
+	}
+	files.GET("/:name", requireReadAccess, limitDownloads, getFile)
+	// The unlock page posts the password back to the same URL
+	files.POST("/:name", requireReadAccess, limitDownloads, getFile)
 	// CORS preflight for file routes — browsers send OPTIONS when the GET carries
 	// custom headers (e.g. Range from probe-via-GET-bytes-0-0).
 	files.OPTIONS("/:name", func(c *gin.Context) {
@@ -275,23 +717,23 @@ func StartServer() {
 		c.Header("Access-Control-Max-Age", "86400")
 		c.Status(http.StatusNoContent)
 	})
-	files.OPTIONS("/:name/:alias", func(c *gin.Context) {
+	files.OPTIONS("/:name/*path", func(c *gin.Context) {
 		setCORSHeaders(c)
 		c.Header("Access-Control-Allow-Headers", "Range, Content-Type")
 		c.Header("Access-Control-Max-Age", "86400")
 		c.Status(http.StatusNoContent)
 	})
-	files.HEAD("/:name", func(c *gin.Context) {
+	files.HEAD("/:name", requireReadAccess, func(c *gin.Context) {
 		var f File
 		if err := c.ShouldBindUri(&f); err != nil {
 			c.Status(http.StatusBadRequest)
 			return
 		}
-		mime, size, err := GetMimeInfo(f.Name)
-		deliverHead(c, err, mime, size)
+		info, err := GetMimeInfo(f.Name)
+		deliverHead(c, err, info)
 	})
 
-	files.GET("/:name/p", func(c *gin.Context) {
+	getPaste := func(c *gin.Context) {
 		var f File
 		if err := c.ShouldBindUri(&f); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err})
@@ -302,6 +744,20 @@ func StartServer() {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		defer func() { file.Close() }()
+		if err := unlockFile(c, file); err != nil {
+			requestPassword(c, err)
+			return
+		}
+		if err := file.consume(); err != nil {
+			c.HTML(http.StatusNotFound, "404.tmpl", gin.H{})
+			return
+		}
+		code, err := file.readAll()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 		params := c.Request.URL.Query()
 		lang := ""
 		for _, param := range []string{"language", "lang", "l"} {
@@ -315,38 +771,109 @@ func StartServer() {
 			"title":          settings.AppName,
 			"filename":       file.name,
 			"class":          lang,
-			"code":           string(file.content),
+			"code":           string(code),
 			"pasteLanguages": LANGUAGE_NAMES_MAP,
 		})
-	})
-
-	files.GET("/:name/:alias", func(c *gin.Context) {
+	}
+	getBucketFile := func(c *gin.Context) {
 		var fb FileBucket
 		if err := c.ShouldBindUri(&fb); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err})
 			return
 		}
-		file, err := DownloadFromBucket(fb.Bucket, fb.Name)
+		version, err := aliasVersion(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		file, err := DownloadFromBucket(fb.Bucket, fb.Alias(), version)
 		deliverFile(c, err, file, c.Request.URL.Query().Get("download") != "")
-	})
-	files.HEAD("/:name/:alias", func(c *gin.Context) {
+	}
+	// Everything below /:name/ shares one route so aliases can have slashes: the paste view of short names
+	// at /:name/p, files at /:bucket/*path and directories ending with a slash. Directories serve their
+	// index.html if they have one and are listed otherwise
+	getBucketPath := func(c *gin.Context) {
+		var fb FileBucket
+		if err := c.ShouldBindUri(&fb); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err})
+			return
+		}
+		alias := fb.Alias()
+		if alias == "p" {
+			setAliasParam(c, "")
+			runHandlers(c, requireReadAccess, limitDownloads, getPaste)
+			return
+		}
+		if isDirectory(alias) {
+			index, err := directoryIndex(fb.Bucket, alias)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if index == "" {
+				runHandlers(c, requireListAccess, bucketIndexPage)
+				return
+			}
+			setAliasParam(c, index)
+		} else if redirected, err := redirectToDirectory(c, fb.Bucket, alias); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if redirected {
+			return
+		}
+		runHandlers(c, requireReadAccess, limitDownloads, getBucketFile)
+	}
+	files.GET("/:name/*path", getBucketPath)
+	files.POST("/:name/*path", getBucketPath)
+	files.HEAD("/:name/*path", func(c *gin.Context) {
 		var fb FileBucket
 		if err := c.ShouldBindUri(&fb); err != nil {
 			c.Status(http.StatusBadRequest)
 			return
 		}
-		mime, size, err := GetMimeInfoFromBucket(fb.Bucket, fb.Name)
-		deliverHead(c, err, mime, size)
+		alias := fb.Alias()
+		if isDirectory(alias) {
+			index, err := directoryIndex(fb.Bucket, alias)
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			if index == "" {
+				runHandlers(c, requireListAccess, func(c *gin.Context) {
+					_, status, _ := listBucket(c)
+					c.Header("Content-Type", "text/html; charset=utf-8")
+					c.Status(status)
+				})
+				return
+			}
+			setAliasParam(c, index)
+			alias = index
+		} else if redirected, err := redirectToDirectory(c, fb.Bucket, alias); err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		} else if redirected {
+			return
+		}
+		runHandlers(c, requireReadAccess, func(c *gin.Context) {
+			version, err := aliasVersion(c)
+			if err != nil {
+				c.Status(http.StatusBadRequest)
+				return
+			}
+			info, err := GetMimeInfoFromBucket(fb.Bucket, alias, version)
+			deliverHead(c, err, info)
+		})
 	})
 
-	files.HEAD("/group/:group", func(c *gin.Context) {
+	files.HEAD("/group/:group", requireReadAccess, func(c *gin.Context) {
 		groupParam := c.Param("group")
 		for _, fileName := range strings.Split(groupParam, ",") {
 			fileName = strings.TrimSpace(fileName)
 			if fileName == "" {
 				continue
 			}
-			if _, _, err := GetMimeInfo(fileName); err == nil {
+			// Private files the request can not read do not exist for it, like on the page
+			if row, err := GetDB().findByShortName(fileName); err == nil && canRead(c, row.private) {
 				c.Header("Content-Type", "text/html; charset=utf-8")
 				c.Status(http.StatusOK)
 				return
@@ -355,7 +882,7 @@ func StartServer() {
 		c.Status(http.StatusNotFound)
 	})
 
-	files.GET("/group/:group", func(c *gin.Context) {
+	files.GET("/group/:group", requireReadAccess, func(c *gin.Context) {
 		groupParam := c.Param("group")
 		fileNames := strings.Split(groupParam, ",")
 
@@ -366,7 +893,6 @@ func StartServer() {
 
 		type GroupFile struct {
 			Name        string
-			Content     []byte
 			MimeType    string
 			Size        string
 			Exists      bool
@@ -375,6 +901,12 @@ func StartServer() {
 			IsAudio     bool
 			IsVideo     bool
 			PreviewText string
+			// Previews would count as downloads so they are not shown
+			Limited       bool
+			DownloadsLeft int64
+			// Nothing about password protected files is shown
+			Locked       bool
+			OriginalName string
 		}
 
 		var groupFiles []GroupFile
@@ -391,30 +923,46 @@ func StartServer() {
 				Name:   fileName,
 				Exists: false,
 			}
+			// Private files the request can not read are shown as missing so their existence is not revealed
+			if err == nil && !canRead(c, file.private()) {
+				file.Close()
+				err = sql.ErrNoRows
+			}
 
-			if err == nil {
+			if err == nil && file.locked() {
+				groupFile.Exists = true
+				groupFile.Locked = true
+				file.Close()
+				validFiles++
+			} else if err == nil {
 				groupFile.Exists = true
-				groupFile.Content = file.content
+				groupFile.OriginalName = file.row.originalName
 				groupFile.MimeType = file.mimetype
-				groupFile.Size = humanReadableSize(len(file.content))
+				groupFile.Size = humanReadableSize(file.size)
+				groupFile.Limited = file.limited()
+				groupFile.DownloadsLeft = file.row.downloadsLeft
 
 				// Determine file type for preview
-				if strings.HasPrefix(file.mimetype, "text/") || strings.Contains(file.mimetype, "json") || strings.Contains(file.mimetype, "xml") {
+				switch {
+				case groupFile.Limited:
+					// Previews of files with limited downloads would use them up
+				case strings.HasPrefix(file.mimetype, "text/") || strings.Contains(file.mimetype, "json") || strings.Contains(file.mimetype, "xml"):
 					groupFile.IsText = true
 					// Limit preview text to first 500 characters
-					content := string(file.content)
-					if len(content) > 500 {
-						groupFile.PreviewText = content[:500] + "..."
+					preview, _ := io.ReadAll(io.LimitReader(file.content, 501))
+					if len(preview) > 500 {
+						groupFile.PreviewText = string(preview[:500]) + "..."
 					} else {
-						groupFile.PreviewText = content
+						groupFile.PreviewText = string(preview)
 					}
-				} else if strings.HasPrefix(file.mimetype, "image/") {
+				case strings.HasPrefix(file.mimetype, "image/"):
 					groupFile.IsImage = true
-				} else if strings.HasPrefix(file.mimetype, "audio/") {
+				case strings.HasPrefix(file.mimetype, "audio/"):
 					groupFile.IsAudio = true
-				} else if strings.HasPrefix(file.mimetype, "video/") {
+				case strings.HasPrefix(file.mimetype, "video/"):
 					groupFile.IsVideo = true
 				}
+				file.Close()
 				validFiles++
 			}
 
@@ -443,9 +991,11 @@ func StartServer() {
 			"title":          settings.AppName,
 			"filesize":       formatIntUnlimitedIf0(settings.FileSizeLimit),
 			"persistance":    formatIntUnlimitedIf0(settings.FilePersistanceTime),
+			"expiryOptions":  expiryOptions(),
 			"ratelimit":      formatIntUnlimitedIf0(settings.IPDayRateLimit),
 			"storeLimit":     settings.IsStorePathSizeLimitEnabled(),
 			"authRequired":   settings.IsAuthEnabled(),
+			"privateUploads": settings.DownloadAuth == DOWNLOAD_AUTH_PER_FILE,
 			"uploadEP":       getHostUrl(c.Request),
 			"pasteLanguages": LANGUAGE_NAMES_MAP,
 		})
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are kept in migrations/{dialect}, named {version}_{name}.sql and applied in order of
+// version, each one in its own transaction. Every dialect has the same versions. Applied migrations
+// must never be edited, add a new one instead.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+const MIGRATIONS_DIR = "migrations"
+
+// Held while migrating a Postgres database so instances starting together do not migrate it twice
+const MIGRATIONS_LOCK_ID = 0x67697261
+
+type Migration struct {
+	Version int
+	Name    string
+	sql     string
+}
+
+type MigrationStatus struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	// Nil if the migration is pending
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join(MIGRATIONS_DIR, dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []Migration{}
+	for _, entry := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		number, err := strconv.Atoi(version)
+		if !ok || err != nil || number <= 0 {
+			return nil, fmt.Errorf("migration %s is not named {version}_{name}.sql", entry.Name())
+		}
+		content, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: number, Name: name, sql: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("there are two migrations with version %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Serializes migrations between instances sharing a Postgres database until tx ends.
+// SQLite already does so with its write lock.
+func lockMigrations(tx *dbTx) error {
+	if tx.dialect != DIALECT_POSTGRES {
+		return nil
+	}
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", MIGRATIONS_LOCK_ID)
+	return err
+}
+
+func (db *DBHelper) createSchemaVersionTable() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := lockMigrations(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at BIGINT NOT NULL
+    );
+  `)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Latest applied migration, 0 for an empty or legacy database
+func (db *DBHelper) schemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// Applies the pending migrations. Returns how many were applied
+func (db *DBHelper) Migrate() (int, error) {
+	migrations, err := loadMigrations(db.dialect())
+	if err != nil {
+		return 0, err
+	}
+	if err := db.createSchemaVersionTable(); err != nil {
+		return 0, err
+	}
+	current, err := db.schemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	latest := migrations[len(migrations)-1].Version
+	if current > latest {
+		return 0, fmt.Errorf("the database schema version %d is newer than the latest one this build knows, %d", current, latest)
+	}
+
+	applied := 0
+	// Postgres is only supported since migrations exist
+	if current == 0 && db.dialect() == DIALECT_SQLITE {
+		legacy, err := tableExists(db, DIALECT_SQLITE, "files")
+		if err != nil {
+			return 0, err
+		}
+		if legacy {
+			if err := db.adopt(migrations[0]); err != nil {
+				return 0, fmt.Errorf("adopting a database from before migrations: %w", err)
+			}
+			current = migrations[0].Version
+			applied++
+		}
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		done, err := db.apply(migration)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		if done {
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// Returns false if another instance applied the migration in the meantime
+func (db *DBHelper) apply(migration Migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := lockMigrations(tx); err != nil {
+		return false, err
+	}
+	var count int
+	if err := tx.QueryRow("SELECT count(*) FROM schema_version WHERE version = ?", migration.Version).Scan(&count); err != nil || count > 0 {
+		return false, err
+	}
+
+	slog.Info(fmt.Sprintf("Applying migration %d %s", migration.Version, migration.Name))
+	if _, err := tx.Exec(migration.sql); err != nil {
+		return false, err
+	}
+	if err := recordMigration(tx, migration); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Brings a database from before migrations to the first migration's schema instead of running it
+func (db *DBHelper) adopt(baseline Migration) error {
+	slog.Info(fmt.Sprintf("Upgrading a database from before migrations to version %d %s", baseline.Version, baseline.Name))
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	fillSizes, err := adoptLegacySchema(tx)
+	if err != nil {
+		return err
+	}
+	if err := recordMigration(tx, baseline); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if fillSizes {
+		return db.fillBlobSizes()
+	}
+	return nil
+}
+
+func recordMigration(tx *dbTx, migration Migration) error {
+	_, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+		migration.Version, migration.Name, time.Now().Unix())
+	return err
+}
+
+// Every known migration and when it was applied
+func (db *DBHelper) Migrations() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(db.dialect())
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int]time.Time{}
+	exists, err := tableExists(db, db.dialect(), "schema_version")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		rows, err := db.Query("SELECT version, applied_at FROM schema_version")
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = rows.Close() }()
+		for rows.Next() {
+			var version int
+			var appliedAt int64
+			if err := rows.Scan(&version, &appliedAt); err != nil {
+				return nil, err
+			}
+			applied[version] = time.Unix(appliedAt, 0)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	status := []MigrationStatus{}
+	for _, migration := range migrations {
+		s := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			s.AppliedAt = &appliedAt
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
@@ -0,0 +1,197 @@
+package api_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/matheusfillipe/girafiles/api"
+)
+
+func openTestDatabase(t *testing.T) *api.DBHelper {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "files.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return &api.DBHelper{DB: db}
+}
+
+func exec(t *testing.T, db *api.DBHelper, statements ...string) {
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+}
+
+func checkFullyMigrated(t *testing.T, db *api.DBHelper) {
+	migrations, err := db.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Expected at least one migration")
+	}
+	for _, migration := range migrations {
+		if migration.AppliedAt == nil {
+			t.Fatalf("Expected migration %d %s to be applied", migration.Version, migration.Name)
+		}
+	}
+
+	applied, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 0 {
+		t.Fatalf("Expected migrating again to do nothing, %d migrations were applied", applied)
+	}
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	db := openTestDatabase(t)
+	applied, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied == 0 {
+		t.Fatal("Expected migrations to be applied")
+	}
+	checkFullyMigrated(t, db)
+
+	exec(t, db, "INSERT INTO files (filename, origin, timestamp, shortname, original_name) VALUES ('a.txt', '::1', 1, 'BB', 'a.txt')")
+	exec(t, db, "INSERT INTO blobs (name, size, refcount, timestamp) VALUES ('a.txt', 1, 1, 1)")
+}
+
+// Databases created before migrations existed are upgraded keeping their rows
+func TestMigrateLegacyDatabase(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema []string
+		rows   []string
+	}{
+		{
+			name: "first release",
+			schema: []string{`
+        CREATE TABLE files (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            filename TEXT NOT NULL UNIQUE,
+            bucket TEXT,
+            alias TEXT,
+            origin TEXT NOT NULL,
+            timestamp INTEGER NOT NULL
+        );
+        CREATE INDEX files_origin ON files (origin);
+        CREATE INDEX files_filename ON files (filename);
+        CREATE INDEX files_timestamp ON files (timestamp);
+        CREATE INDEX files_bucket ON files (bucket);
+        CREATE INDEX files_alias ON files (alias);
+      `},
+			rows: []string{
+				"INSERT INTO files (filename, bucket, alias, origin, timestamp) VALUES ('abc.txt', NULL, NULL, '::1', 1000)",
+				"INSERT INTO files (filename, bucket, alias, origin, timestamp) VALUES ('abc.txt@1', 'bucket', 'alias', '::1', 1001)",
+				"INSERT INTO files (filename, bucket, alias, origin, timestamp) VALUES ('def.png', NULL, NULL, '::1', 1002)",
+			},
+		},
+		{
+			name: "last release without migrations",
+			schema: []string{`
+        CREATE TABLE files (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            filename TEXT NOT NULL,
+            bucket TEXT,
+            alias TEXT,
+            origin TEXT NOT NULL,
+            timestamp INTEGER NOT NULL,
+            delete_token TEXT,
+            expires_at INTEGER,
+            downloads_left INTEGER,
+            password_hash TEXT,
+            shortname TEXT,
+            original_name TEXT
+        );
+        CREATE TABLE blobs (
+            name TEXT PRIMARY KEY,
+            size INTEGER NOT NULL,
+            refcount INTEGER NOT NULL,
+            timestamp INTEGER NOT NULL
+        );
+        CREATE UNIQUE INDEX files_shortname ON files (shortname);
+      `},
+			rows: []string{
+				"INSERT INTO files (filename, bucket, alias, origin, timestamp, shortname) VALUES ('abc.txt', NULL, NULL, '::1', 1000, 'BB')",
+				"INSERT INTO files (filename, bucket, alias, origin, timestamp, shortname) VALUES ('abc.txt', 'bucket', 'alias', '::1', 1001, 'BC')",
+				"INSERT INTO files (filename, bucket, alias, origin, timestamp, shortname) VALUES ('def.png', NULL, NULL, '::1', 1002, 'BD')",
+				"INSERT INTO blobs (name, size, refcount, timestamp) VALUES ('abc.txt', 3, 2, 1000)",
+				"INSERT INTO blobs (name, size, refcount, timestamp) VALUES ('def.png', 4, 1, 1002)",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDatabase(t)
+			exec(t, db, test.schema...)
+			exec(t, db, test.rows...)
+
+			if _, err := db.Migrate(); err != nil {
+				t.Fatal(err)
+			}
+			checkFullyMigrated(t, db)
+
+			rows, err := db.Query("SELECT id, filename, shortname, original_name FROM files ORDER BY id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = rows.Close() }()
+			expected := []string{"abc.txt", "abc.txt", "def.png"}
+			i := 0
+			for rows.Next() {
+				var id int64
+				var filename, shortname string
+				var originalName sql.NullString
+				if err := rows.Scan(&id, &filename, &shortname, &originalName); err != nil {
+					t.Fatal(err)
+				}
+				if filename != expected[i] {
+					t.Fatalf("Expected row %d to point at %s, got %s", id, expected[i], filename)
+				}
+				if shortname != api.IdxToString(id) {
+					t.Fatalf("Expected row %d to keep the short name %s, got %s", id, api.IdxToString(id), shortname)
+				}
+				i++
+			}
+			if i != len(expected) {
+				t.Fatalf("Expected %d rows, got %d", len(expected), i)
+			}
+
+			var refcount int
+			if err := db.QueryRow("SELECT refcount FROM blobs WHERE name = 'abc.txt'").Scan(&refcount); err != nil {
+				t.Fatal(err)
+			}
+			if refcount != 2 {
+				t.Fatalf("Expected abc.txt to be referenced twice, got %d", refcount)
+			}
+
+			var version int64
+			if err := db.QueryRow("SELECT version FROM files WHERE bucket = 'bucket' AND alias = 'alias'").Scan(&version); err != nil {
+				t.Fatal(err)
+			}
+			if version != 1 {
+				t.Fatalf("Expected the existing alias to become version 1, got %d", version)
+			}
+		})
+	}
+}
+
+// A database migrated by a newer build is not touched
+func TestMigrateNewerDatabase(t *testing.T) {
+	db := openTestDatabase(t)
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "INSERT INTO schema_version (version, name, applied_at) VALUES (100000, 'from the future', 0)")
+	if _, err := db.Migrate(); err == nil {
+		t.Fatal("Expected an error migrating a database newer than the build")
+	}
+}
@@ -0,0 +1,29 @@
+CREATE TABLE files (
+    id BIGSERIAL PRIMARY KEY,
+    filename TEXT NOT NULL,
+    bucket TEXT,
+    alias TEXT,
+    origin TEXT NOT NULL,
+    timestamp BIGINT NOT NULL,
+    delete_token TEXT,
+    expires_at BIGINT,
+    downloads_left BIGINT,
+    password_hash TEXT,
+    shortname TEXT,
+    original_name TEXT
+);
+
+CREATE TABLE blobs (
+    name TEXT PRIMARY KEY,
+    size BIGINT NOT NULL,
+    refcount BIGINT NOT NULL,
+    timestamp BIGINT NOT NULL
+);
+
+CREATE INDEX files_origin ON files (origin);
+CREATE INDEX files_filename ON files (filename);
+CREATE INDEX files_timestamp ON files (timestamp);
+CREATE INDEX files_bucket ON files (bucket);
+CREATE INDEX files_alias ON files (alias);
+CREATE INDEX files_expires_at ON files (expires_at);
+CREATE UNIQUE INDEX files_shortname ON files (shortname);
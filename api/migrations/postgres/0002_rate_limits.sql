@@ -0,0 +1,10 @@
+-- Rate limit counters kept across restarts when RATE_LIMIT_PERSIST is enabled
+CREATE TABLE rate_limits (
+    limiter TEXT NOT NULL,
+    client TEXT NOT NULL,
+    window_seconds BIGINT NOT NULL,
+    window_start BIGINT NOT NULL,
+    current_count BIGINT NOT NULL,
+    previous_count BIGINT NOT NULL,
+    PRIMARY KEY (limiter, client, window_seconds)
+);
@@ -0,0 +1,2 @@
+-- Files that need credentials to be downloaded when DOWNLOAD_AUTH is per-file
+ALTER TABLE files ADD COLUMN private INTEGER NOT NULL DEFAULT 0;
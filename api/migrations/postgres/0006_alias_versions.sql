@@ -0,0 +1,7 @@
+-- Bucket aliases keep their previous uploads as numbered versions. Existing ones are numbered in upload order
+ALTER TABLE files ADD COLUMN version BIGINT;
+UPDATE files SET version = (
+    SELECT COUNT(*) FROM files AS previous
+    WHERE previous.bucket = files.bucket AND previous.alias = files.alias AND previous.id <= files.id
+) WHERE bucket IS NOT NULL AND alias IS NOT NULL;
+CREATE UNIQUE INDEX files_alias_version ON files (bucket, alias, version);
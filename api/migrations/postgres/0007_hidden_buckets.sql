@@ -0,0 +1,2 @@
+-- Only owners can list their bucket until they show it to everyone, the files stay downloadable
+ALTER TABLE buckets ADD COLUMN hidden INTEGER NOT NULL DEFAULT 1;
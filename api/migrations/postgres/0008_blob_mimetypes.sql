@@ -0,0 +1,2 @@
+-- Detected when a blob is uploaded so listings do not have to read it. Blobs from before stay NULL
+ALTER TABLE blobs ADD COLUMN mimetype TEXT;
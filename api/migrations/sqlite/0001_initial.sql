@@ -0,0 +1,31 @@
+-- Schema of databases created before migrations existed. Those are brought up to this version by
+-- adoptLegacySchema instead of running this file.
+CREATE TABLE files (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    filename TEXT NOT NULL,
+    bucket TEXT,
+    alias TEXT,
+    origin TEXT NOT NULL,
+    timestamp INTEGER NOT NULL,
+    delete_token TEXT,
+    expires_at INTEGER,
+    downloads_left INTEGER,
+    password_hash TEXT,
+    shortname TEXT,
+    original_name TEXT
+);
+
+CREATE TABLE blobs (
+    name TEXT PRIMARY KEY,
+    size INTEGER NOT NULL,
+    refcount INTEGER NOT NULL,
+    timestamp INTEGER NOT NULL
+);
+
+CREATE INDEX files_origin ON files (origin);
+CREATE INDEX files_filename ON files (filename);
+CREATE INDEX files_timestamp ON files (timestamp);
+CREATE INDEX files_bucket ON files (bucket);
+CREATE INDEX files_alias ON files (alias);
+CREATE INDEX files_expires_at ON files (expires_at);
+CREATE UNIQUE INDEX files_shortname ON files (shortname);
@@ -0,0 +1,7 @@
+-- Buckets belong to whoever wrote to them first, a user or the holder of the bucket token
+CREATE TABLE buckets (
+    name TEXT PRIMARY KEY,
+    owner TEXT,
+    token_hash TEXT,
+    created_at INTEGER NOT NULL
+);
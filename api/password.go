@@ -0,0 +1,33 @@
+package api
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrPasswordRequired = errors.New("this file is password protected")
+var ErrWrongPassword = errors.New("wrong password")
+
+// Salted bcrypt hash of a file password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Checks the password of a file. Files without a password hash are not protected
+func checkPassword(password string, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	if password == "" {
+		return ErrPasswordRequired
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
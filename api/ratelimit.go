@@ -0,0 +1,343 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RATE_LIMITER_UPLOADS       = "uploads"
+	RATE_LIMITER_DOWNLOADS     = "downloads"
+	RATE_LIMITER_AUTH_FAILURES = "auth_failures"
+)
+
+// How often counters are written to the database when RATE_LIMIT_PERSIST is enabled
+const RATE_LIMIT_PERSIST_INTERVAL = 10 * time.Second
+
+// Clients that did not make requests for this long are forgotten if none of their windows are longer
+const RATE_LIMIT_SWEEP_INTERVAL = time.Minute
+
+type RateLimitWindow struct {
+	// Used in the error message, "rate limit per {name} exceeded"
+	Name  string
+	Size  time.Duration
+	Limit int
+}
+
+// Sliding window approximated from the counts of the current and previous fixed windows
+type windowCounter struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+// Moves the fixed window forward to the one now is in
+func (w *windowCounter) advance(now time.Time, size time.Duration) {
+	start := now.Truncate(size)
+	switch {
+	case start.Equal(w.start):
+	case start.Equal(w.start.Add(size)):
+		w.start, w.previous, w.current = start, w.current, 0
+	default:
+		w.start, w.previous, w.current = start, 0, 0
+	}
+}
+
+// Requests in the last size, the previous window weighted by how much of it is still inside
+func (w *windowCounter) count(now time.Time, size time.Duration) float64 {
+	inside := 1 - float64(now.Sub(w.start))/float64(size)
+	return float64(w.previous)*inside + float64(w.current)
+}
+
+// How long until one more request fits under limit
+func (w *windowCounter) retryAfter(now time.Time, size time.Duration, limit int) time.Duration {
+	free := float64(limit - 1)
+	var at time.Time
+	if float64(w.current) <= free {
+		// Still in this window, once enough of the previous one slid out
+		at = w.start.Add(time.Duration(float64(size) * (1 - (free-float64(w.current))/float64(w.previous))))
+	} else {
+		// In the next window, once enough of this one slid out
+		at = w.start.Add(size).Add(time.Duration(float64(size) * (1 - free/float64(w.current))))
+	}
+	return at.Sub(now)
+}
+
+type RateLimitResult struct {
+	Allowed bool
+	// Of the window closest to its limit
+	Limit     int
+	Remaining int
+	// Until the current fixed window of that window ends
+	Reset time.Duration
+	// Set when the request was not allowed
+	RetryAfter time.Duration
+	// Window that was exceeded
+	Exceeded string
+}
+
+type RateLimiter struct {
+	name    string
+	windows []RateLimitWindow
+	lock    sync.Mutex
+	clients map[string][]windowCounter
+	// Clients changed since the counters were last persisted
+	dirty     map[string]bool
+	lastSweep time.Time
+}
+
+// Windows with a limit of 0 are ignored. Returns nil if there is nothing to limit
+func NewRateLimiter(name string, windows ...RateLimitWindow) *RateLimiter {
+	enabled := []RateLimitWindow{}
+	for _, window := range windows {
+		if window.Limit > 0 {
+			enabled = append(enabled, window)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+	return &RateLimiter{name: name, windows: enabled, clients: map[string][]windowCounter{}, dirty: map[string]bool{}}
+}
+
+// Counts a request of client if it is under every limit
+func (l *RateLimiter) Allow(client string, now time.Time) RateLimitResult {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+
+	counters, ok := l.clients[client]
+	if !ok {
+		counters = make([]windowCounter, len(l.windows))
+		l.clients[client] = counters
+	}
+
+	result := RateLimitResult{Allowed: true, Remaining: math.MaxInt}
+	for i, window := range l.windows {
+		counter := &counters[i]
+		counter.advance(now, window.Size)
+		count := counter.count(now, window.Size)
+		if count+1 > float64(window.Limit) {
+			result.Allowed = false
+			if retry := counter.retryAfter(now, window.Size, window.Limit); retry >= result.RetryAfter {
+				result.RetryAfter = retry
+				result.Exceeded = window.Name
+			}
+		}
+		remaining := max(window.Limit-int(math.Ceil(count))-1, 0)
+		if remaining < result.Remaining {
+			result.Limit = window.Limit
+			result.Remaining = remaining
+			result.Reset = counter.start.Add(window.Size).Sub(now)
+		}
+	}
+
+	if result.Allowed {
+		for i := range counters {
+			counters[i].current++
+		}
+		l.dirty[client] = true
+	} else {
+		result.Remaining = 0
+	}
+	return result
+}
+
+// Takes back a request of client allowed at the given time, e.g. because it failed
+func (l *RateLimiter) Refund(client string, at time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	counters, ok := l.clients[client]
+	if !ok {
+		return
+	}
+	for i, window := range l.windows {
+		counter := &counters[i]
+		start := at.Truncate(window.Size)
+		switch {
+		case counter.start.Equal(start) && counter.current > 0:
+			counter.current--
+		case counter.start.Equal(start.Add(window.Size)) && counter.previous > 0:
+			counter.previous--
+		}
+	}
+	l.dirty[client] = true
+}
+
+// Forgets clients whose counters are all zero by now
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < RATE_LIMIT_SWEEP_INTERVAL {
+		return
+	}
+	l.lastSweep = now
+	for client, counters := range l.clients {
+		idle := true
+		for i, window := range l.windows {
+			if now.Sub(counters[i].start) < 2*window.Size {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			delete(l.clients, client)
+			delete(l.dirty, client)
+		}
+	}
+}
+
+// Writes the counters that changed since the last call to the database
+func (l *RateLimiter) persist() error {
+	l.lock.Lock()
+	counters := []rateLimitRow{}
+	for client := range l.dirty {
+		for i, window := range l.windows {
+			c := l.clients[client][i]
+			counters = append(counters, rateLimitRow{l.name, client, window.Size, c.start, c.current, c.previous})
+		}
+	}
+	l.dirty = map[string]bool{}
+	l.lock.Unlock()
+
+	db := GetDB()
+	if err := db.saveRateLimits(counters); err != nil {
+		return err
+	}
+	return db.deleteStaleRateLimits(l.name, time.Now())
+}
+
+// Loads the counters persisted by a previous run
+func (l *RateLimiter) restore() error {
+	rows, err := GetDB().loadRateLimits(l.name)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, row := range rows {
+		i := slices.IndexFunc(l.windows, func(w RateLimitWindow) bool { return w.Size == row.size })
+		if i < 0 {
+			continue
+		}
+		if _, ok := l.clients[row.client]; !ok {
+			l.clients[row.client] = make([]windowCounter, len(l.windows))
+		}
+		l.clients[row.client][i] = windowCounter{start: row.start, current: row.current, previous: row.previous}
+	}
+	return nil
+}
+
+// Keeps the counters in the database so restarting does not reset them
+func (l *RateLimiter) startPersisting() {
+	if err := l.restore(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to restore %s rate limits: %s", l.name, err))
+	}
+	go func() {
+		for range time.Tick(RATE_LIMIT_PERSIST_INTERVAL) {
+			if err := l.persist(); err != nil {
+				slog.Error(fmt.Sprintf("Failed to persist %s rate limits: %s", l.name, err))
+			}
+		}
+	}()
+}
+
+func rateLimitWindows(minute int, hour int, day int) []RateLimitWindow {
+	return []RateLimitWindow{
+		{Name: "minute", Size: time.Minute, Limit: minute},
+		{Name: "hour", Size: time.Hour, Limit: hour},
+		{Name: "day", Size: 24 * time.Hour, Limit: day},
+	}
+}
+
+// Rejects requests over the limit with 429. Does nothing if limiter is nil.
+func rateLimit(limiter *RateLimiter) gin.HandlerFunc {
+	settings := GetSettings()
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		if limiter == nil || settings.IsRateLimitExcluded(ip) {
+			c.Next()
+			return
+		}
+
+		result := limiter.Allow(settings.RateLimitClient(ip), time.Now())
+		c.Header("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(result.RetryAfter.Seconds())), 1)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("rate limit per %s exceeded", result.Exceeded)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Counts failed authentication attempts, set by startRateLimiters. Nil if they are not limited
+var authFailureLimiter *RateLimiter
+
+// Gin context key set when the credentials of a request were not checked because of too many failures
+const AUTH_RATE_LIMITED_KEY = "auth_rate_limited"
+
+// Counts an authentication attempt of the client of c. Returns false without counting if it made too many
+// failed ones, the credentials must not be checked then. done has to be called with whether they were valid.
+func allowAuthAttempt(c *gin.Context) (allowed bool, done func(ok bool)) {
+	settings := GetSettings()
+	ip := c.ClientIP()
+	if authFailureLimiter == nil || settings.IsRateLimitExcluded(ip) {
+		return true, func(bool) {}
+	}
+	client, now := settings.RateLimitClient(ip), time.Now()
+	result := authFailureLimiter.Allow(client, now)
+	if !result.Allowed {
+		c.Set(AUTH_RATE_LIMITED_KEY, result)
+		return false, func(bool) {}
+	}
+	// Only failures count
+	return true, func(ok bool) {
+		if ok {
+			authFailureLimiter.Refund(client, now)
+		}
+	}
+}
+
+// Answers with 429 if the credentials of c were not checked because of too many failed attempts
+func abortAuthRateLimited(c *gin.Context) bool {
+	value, exists := c.Get(AUTH_RATE_LIMITED_KEY)
+	if !exists {
+		return false
+	}
+	result := value.(RateLimitResult)
+	c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(result.RetryAfter.Seconds())), 1)))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("too many failed authentication attempts per %s", result.Exceeded)})
+	return true
+}
+
+// Middlewares limiting uploads and downloads per IP according to the settings. Failed authentication
+// attempts are limited too
+func startRateLimiters() (gin.HandlerFunc, gin.HandlerFunc) {
+	settings := GetSettings()
+	uploads := NewRateLimiter(RATE_LIMITER_UPLOADS,
+		rateLimitWindows(settings.IPMinRateLimit, settings.IPHourRateLimit, settings.IPDayRateLimit)...)
+	downloads := NewRateLimiter(RATE_LIMITER_DOWNLOADS,
+		rateLimitWindows(settings.IPMinDownloadRateLimit, settings.IPHourDownloadRateLimit, settings.IPDayDownloadRateLimit)...)
+	authFailureLimiter = NewRateLimiter(RATE_LIMITER_AUTH_FAILURES,
+		rateLimitWindows(settings.IPMinAuthFailureLimit, settings.IPHourAuthFailureLimit, 0)...)
+
+	if settings.RateLimitPersist {
+		for _, limiter := range []*RateLimiter{uploads, downloads, authFailureLimiter} {
+			if limiter != nil {
+				limiter.startPersisting()
+			}
+		}
+	}
+	return rateLimit(uploads), rateLimit(downloads)
+}
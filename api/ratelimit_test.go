@@ -0,0 +1,145 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matheusfillipe/girafiles/api"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	if api.NewRateLimiter("test", api.RateLimitWindow{Name: "minute", Size: time.Minute}) == nil {
+		t.Log("Limiter without limits is nil")
+	} else {
+		t.Fatal("Expected a limiter without limits to be nil")
+	}
+
+	limiter := api.NewRateLimiter("test",
+		api.RateLimitWindow{Name: "minute", Size: time.Minute, Limit: 3},
+		api.RateLimitWindow{Name: "hour", Size: time.Hour, Limit: 10},
+	)
+	now := time.Date(2024, 1, 1, 12, 0, 50, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		result := limiter.Allow("a", now)
+		if !result.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+		if result.Limit != 3 || result.Remaining != 2-i {
+			t.Fatalf("Expected limit 3 with %d remaining, got %d with %d", 2-i, result.Limit, result.Remaining)
+		}
+	}
+	result := limiter.Allow("a", now)
+	if result.Allowed || result.Exceeded != "minute" || result.Remaining != 0 {
+		t.Fatalf("Expected the minute limit to be exceeded, got %+v", result)
+	}
+	if !limiter.Allow("b", now).Allowed {
+		t.Fatal("Expected other clients not to be limited")
+	}
+
+	// 20 seconds into the next minute 2/3 of the previous one still count, 3 * 2/3 + 1 fits
+	result = limiter.Allow("a", now.Add(20*time.Second))
+	if result.Allowed {
+		t.Fatal("Expected the previous minute to still count")
+	}
+	if result.RetryAfter != 10*time.Second {
+		t.Fatalf("Expected to retry after 10s, got %s", result.RetryAfter)
+	}
+	if !limiter.Allow("a", now.Add(30*time.Second)).Allowed {
+		t.Fatal("Expected a request to be allowed once enough of the previous minute slid out")
+	}
+
+	// Rejected requests are not counted
+	for i := 0; i < 6; i++ {
+		later := now.Add(time.Duration(10+i) * time.Minute)
+		if !limiter.Allow("a", later).Allowed {
+			t.Fatalf("Expected request at %s to be allowed", later)
+		}
+	}
+	result = limiter.Allow("a", now.Add(20*time.Minute))
+	if result.Allowed || result.Exceeded != "hour" {
+		t.Fatalf("Expected the hour limit to be exceeded, got %+v", result)
+	}
+	if !limiter.Allow("a", now.Add(2*time.Hour)).Allowed {
+		t.Fatal("Expected the hour limit to be reset two hours later")
+	}
+
+	// Refunded requests give their slot back, also after their window moved on
+	later := now.Add(3 * time.Hour)
+	for i := 0; i < 3; i++ {
+		limiter.Allow("c", later)
+	}
+	limiter.Refund("c", later)
+	if !limiter.Allow("c", later).Allowed {
+		t.Fatal("Expected a refunded request not to count")
+	}
+	if limiter.Allow("c", later.Add(10*time.Second)).Allowed {
+		t.Fatal("Expected the previous minute to still count")
+	}
+	limiter.Refund("c", later)
+	if !limiter.Allow("c", later.Add(10*time.Second)).Allowed {
+		t.Fatal("Expected a request refunded from the previous minute not to count")
+	}
+}
+
+func TestParseIPPrefixes(t *testing.T) {
+	t.Parallel()
+
+	prefixes, err := api.ParseIPPrefixes(" 10.0.0.1, 192.168.1.7/24,2001:db8::/32,::1,::ffff:172.16.0.0/108,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.1/32", "192.168.1.0/24", "2001:db8::/32", "::1/128", "172.16.0.0/12"}
+	if len(prefixes) != len(expected) {
+		t.Fatalf("Expected %d prefixes, got %v", len(expected), prefixes)
+	}
+	for i, prefix := range prefixes {
+		if prefix.String() != expected[i] {
+			t.Fatalf("Expected %s, got %s", expected[i], prefix)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0", "10.0.0.0/33", "localhost", "2001:db8::/129"} {
+		if _, err := api.ParseIPPrefixes(invalid); err == nil {
+			t.Fatalf("Expected '%s' to be rejected", invalid)
+		}
+	}
+}
+
+func TestRateLimitClient(t *testing.T) {
+	t.Parallel()
+
+	excluded, err := api.ParseIPPrefixes("10.0.0.0/8,2001:db8:1::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &api.Settings{RateLimitExcludedIPs: excluded, RateLimitIPv6Prefix: 64}
+
+	tests := []struct {
+		ip       string
+		client   string
+		excluded bool
+	}{
+		{"10.1.2.3", "10.1.2.3", true},
+		{"::ffff:10.1.2.3", "10.1.2.3", true},
+		{"11.1.2.3", "11.1.2.3", false},
+		{"2001:db8:1:2::1", "2001:db8:1:2::/64", true},
+		{"2001:db8:2:3:aaaa::1", "2001:db8:2:3::/64", false},
+		{"2001:db8:2:3:bbbb::2", "2001:db8:2:3::/64", false},
+	}
+	for _, test := range tests {
+		if client := settings.RateLimitClient(test.ip); client != test.client {
+			t.Fatalf("Expected %s to be counted as %s, got %s", test.ip, test.client, client)
+		}
+		if settings.IsRateLimitExcluded(test.ip) != test.excluded {
+			t.Fatalf("Expected %s to be excluded: %t", test.ip, test.excluded)
+		}
+	}
+
+	settings.RateLimitIPv6Prefix = 128
+	if client := settings.RateLimitClient("2001:db8:2:3::1"); client != "2001:db8:2:3::1" {
+		t.Fatalf("Expected IPv6 addresses not to be grouped, got %s", client)
+	}
+}
@@ -2,11 +2,13 @@ package api
 
 import (
 	"log"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -24,60 +26,167 @@ type Settings struct {
 	Debug bool
 	// Path to store the files
 	StorePath string
+	// Database for the file metadata, a postgres:// or sqlite:// url. Defaults to a SQLite database in StorePath
+	DatabaseURL string
 	// File persistance time in hours. 0 to keep files forever
 	FilePersistanceTime int
+	// Maximum persistance time in hours uploaders can ask for. 0 to use FilePersistanceTime
+	MaxFilePersistanceTime int
 	// File size limit in MB
 	FileSizeLimit int
 	// Size limit for STORE_PATH in MB. If exceeded, the oldest files will be deleted first. Set to 0 to disable
 	StorePathSizeLimit int
+	// Once StorePathSizeLimit is exceeded files are deleted until the storage is under this size in MB.
+	// 0 to use StorePathSizeLimit
+	StorePathSizeLowWater int
+	// Seconds between janitor runs deleting expired files and enforcing StorePathSizeLimit. 0 to only run after uploads
+	JanitorInterval int
 	// Users and Passwords. Leave it empty to disable authentication. Format: user1:password1,user2:password2
 	Users map[string]string
+	// htpasswd file with bcrypt or argon2 hashed passwords of more users. Reloaded when it changes
+	UsersFile string
+	// Who can download files. Either "public", "authenticated" or "per-file"
+	DownloadAuth string
+	// Keys signing temporary download URLs. The first one signs, all of them are accepted. Format: id1:secret1,id2:secret2
+	URLSigningKeys []SigningKey
+	// Hours signed URLs can be valid for at most. 0 for no limit
+	URLSigningMaxLifetime int
+	// Versions kept of every bucket alias, counting the current one. Older ones are deleted when a new one is uploaded
+	AliasVersions int
 	// IP Rate Limit per minute. 0 to disable
 	IPMinRateLimit int
 	// IP Rate Limit per hour. 0 to disable
 	IPHourRateLimit int
 	// IP Rate Limit per day. 0 to disable
 	IPDayRateLimit int
-	// Trusted Proxy IP. If behind a proxy, set the proxy IP here. X-Forwarded-For header will be used
-	// to get the real client IP
-	TrustedProxyIP string
-	// The following IPs will be excluded from rate limiting. Format: ip1,ip2
-	RateLimitExcludedIPs []string
+	// Downloads per IP per minute. 0 to disable
+	IPMinDownloadRateLimit int
+	// Downloads per IP per hour. 0 to disable
+	IPHourDownloadRateLimit int
+	// Downloads per IP per day. 0 to disable
+	IPDayDownloadRateLimit int
+	// Failed authentication attempts per IP per minute. 0 to disable
+	IPMinAuthFailureLimit int
+	// Failed authentication attempts per IP per hour. 0 to disable
+	IPHourAuthFailureLimit int
+	// Keep rate limit counters in the database so restarts do not reset them
+	RateLimitPersist bool
+	// Proxies whose X-Forwarded-For and X-Real-Ip headers are used to get the real client IP.
+	// Format: ip1,ip2,10.0.0.0/8,fd00::/8
+	TrustedProxies []netip.Prefix
+	// The following IPs and ranges will be excluded from rate limiting. Format: ip1,ip2,10.0.0.0/8
+	RateLimitExcludedIPs []netip.Prefix
+	// IPv6 clients are rate limited by their network of this prefix length instead of by address. 128 to disable
+	RateLimitIPv6Prefix int
+	// Where file contents are stored. Either "local" (STORE_PATH/data) or "s3"
+	StorageBackend string
+	// S3 compatible service used when StorageBackend is "s3"
+	S3 S3Config
+	// How short names of new uploads are generated. Either "sequential", "random" or "obfuscated"
+	ShortnameMode string
+	// Length of random short names
+	ShortnameLength int
 }
 
 var singleInstance *Settings
 
 func getDefaultSettings() *Settings {
 	return &Settings{
-		AppName:              "GiraFiles",
-		Host:                 "0.0.0.0",
-		Port:                 "8000",
-		Debug:                false,
-		StorePath:            DEFAULT_STORE_PATH,
-		FilePersistanceTime:  0,
-		FileSizeLimit:        100,
-		StorePathSizeLimit:   2048,
-		Users:                map[string]string{},
-		IPMinRateLimit:       0,
-		IPHourRateLimit:      0,
-		IPDayRateLimit:       0,
-		TrustedProxyIP:       "",
-		RateLimitExcludedIPs: []string{},
+		AppName:                "GiraFiles",
+		Host:                   "0.0.0.0",
+		Port:                   "8000",
+		Debug:                  false,
+		StorePath:              DEFAULT_STORE_PATH,
+		FilePersistanceTime:    0,
+		MaxFilePersistanceTime: 0,
+		FileSizeLimit:          100,
+		StorePathSizeLimit:     2048,
+		StorePathSizeLowWater:  0,
+		JanitorInterval:        60,
+		Users:                  map[string]string{},
+		DownloadAuth:           DOWNLOAD_AUTH_PUBLIC,
+		URLSigningKeys:         []SigningKey{},
+		URLSigningMaxLifetime:  24,
+		AliasVersions:          3,
+		IPMinRateLimit:         0,
+		IPHourRateLimit:        0,
+		IPDayRateLimit:         0,
+		IPMinAuthFailureLimit:  10,
+		IPHourAuthFailureLimit: 60,
+		TrustedProxies:         []netip.Prefix{},
+		RateLimitExcludedIPs:   []netip.Prefix{},
+		RateLimitIPv6Prefix:    64,
+		StorageBackend:         STORAGE_BACKEND_LOCAL,
+		S3: S3Config{
+			Region: "us-east-1",
+			UseSSL: true,
+		},
+		ShortnameMode:   SHORTNAME_MODE_SEQUENTIAL,
+		ShortnameLength: 8,
 	}
 }
 
 func (s *Settings) IsAuthEnabled() bool {
-	return len(s.Users) > 0
+	return len(s.Users) > 0 || s.UsersFile != ""
 }
 
 func (s *Settings) IsIPRateLimitEnabled() bool {
 	return s.IPMinRateLimit > 0 || s.IPHourRateLimit > 0 || s.IPDayRateLimit > 0
 }
 
+// Whether ip is in one of RateLimitExcludedIPs
+func (s *Settings) IsRateLimitExcluded(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.RateLimitExcludedIPs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Who ip is counted as by the rate limiters. IPv6 addresses are grouped by RateLimitIPv6Prefix
+// since a single client usually gets a whole network
+func (s *Settings) RateLimitClient(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	if addr.Is4() || s.RateLimitIPv6Prefix <= 0 || s.RateLimitIPv6Prefix >= 128 {
+		return addr.String()
+	}
+	prefix, err := addr.WithZone("").Prefix(s.RateLimitIPv6Prefix)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
+
 func (s *Settings) IsStorePathSizeLimitEnabled() bool {
 	return s.StorePathSizeLimit > 0
 }
 
+// Size in MB the janitor shrinks the storage to once StorePathSizeLimit is exceeded
+func (s *Settings) StorePathSizeLowWaterMark() int {
+	if s.StorePathSizeLowWater > 0 && s.StorePathSizeLowWater < s.StorePathSizeLimit {
+		return s.StorePathSizeLowWater
+	}
+	return s.StorePathSizeLimit
+}
+
+// Longest time a file can be kept for when the uploader chooses the expiry. 0 means forever
+func (s *Settings) MaxPersistance() time.Duration {
+	if s.MaxFilePersistanceTime > 0 {
+		return time.Duration(s.MaxFilePersistanceTime) * time.Hour
+	}
+	return time.Duration(s.FilePersistanceTime) * time.Hour
+}
+
 func (s *Settings) GetFileStoragePath() string {
 	return filepath.Join(s.StorePath, FILEDIR)
 }
@@ -103,6 +212,57 @@ func getEnv(key string, defaultValue string) string {
 	return defaultValue
 }
 
+// Parses a comma separated list of IPs and CIDR ranges, IPv4 or IPv6. Single IPs become /32 or /128 ranges
+func ParseIPPrefixes(list string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, err
+			}
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func getPrefixesEnv(key string, defaultValue []netip.Prefix) []netip.Prefix {
+	if value, exists := os.LookupEnv(key); exists {
+		prefixes, err := ParseIPPrefixes(value)
+		if err != nil {
+			log.Fatalf("Error parsing '%s'. Expected a list of IPs and CIDR ranges separated by comma but got '%s': %s", key, value, err)
+		}
+		return prefixes
+	}
+	return defaultValue
+}
+
+func getSigningKeysEnv(key string, defaultValue []SigningKey) []SigningKey {
+	if value, exists := os.LookupEnv(key); exists {
+		keys, err := ParseSigningKeys(value)
+		if err != nil {
+			log.Fatalf("Error parsing '%s': %s", key, err)
+		}
+		return keys
+	}
+	return defaultValue
+}
+
 func getIntEnv(key string, defaultValue int) int {
 	if value, exists := os.LookupEnv(key); exists {
 		var intValue, err = strconv.Atoi(value)
@@ -126,20 +286,70 @@ func newSettings() *Settings {
 	}
 
 	settings = &Settings{
-		AppName:              getEnv("APP_NAME", settings.AppName),
-		Host:                 getEnv("HOST", settings.Host),
-		Port:                 getEnv("PORT", settings.Port),
-		Debug:                getIntEnv("DEBUG", 0) == 1,
-		StorePath:            getEnv("STORE_PATH", settings.StorePath),
-		FilePersistanceTime:  getIntEnv("FILE_PERSISTANCE_TIME", settings.FilePersistanceTime),
-		FileSizeLimit:        getIntEnv("FILE_SIZE_LIMIT", settings.FileSizeLimit),
-		StorePathSizeLimit:   getIntEnv("STORE_PATH_SIZE_LIMIT", settings.StorePathSizeLimit),
-		Users:                parseAuthUsers(getEnv("USERS", "")),
-		IPMinRateLimit:       getIntEnv("IP_MIN_RATE_LIMIT", settings.IPMinRateLimit),
-		IPHourRateLimit:      getIntEnv("IP_HOUR_RATE_LIMIT", settings.IPHourRateLimit),
-		IPDayRateLimit:       getIntEnv("IP_DAY_RATE_LIMIT", settings.IPDayRateLimit),
-		TrustedProxyIP:       getEnv("TRUSTED_PROXY_IP", settings.TrustedProxyIP),
-		RateLimitExcludedIPs: strings.Split(getEnv("RATE_LIMIT_EXCLUDED_IPS", ""), ","),
+		AppName:                 getEnv("APP_NAME", settings.AppName),
+		Host:                    getEnv("HOST", settings.Host),
+		Port:                    getEnv("PORT", settings.Port),
+		Debug:                   getIntEnv("DEBUG", 0) == 1,
+		StorePath:               getEnv("STORE_PATH", settings.StorePath),
+		DatabaseURL:             getEnv("DATABASE_URL", settings.DatabaseURL),
+		FilePersistanceTime:     getIntEnv("FILE_PERSISTANCE_TIME", settings.FilePersistanceTime),
+		MaxFilePersistanceTime:  getIntEnv("MAX_FILE_PERSISTANCE_TIME", settings.MaxFilePersistanceTime),
+		FileSizeLimit:           getIntEnv("FILE_SIZE_LIMIT", settings.FileSizeLimit),
+		StorePathSizeLimit:      getIntEnv("STORE_PATH_SIZE_LIMIT", settings.StorePathSizeLimit),
+		StorePathSizeLowWater:   getIntEnv("STORE_PATH_SIZE_LOW_WATER", settings.StorePathSizeLowWater),
+		JanitorInterval:         getIntEnv("JANITOR_INTERVAL", settings.JanitorInterval),
+		Users:                   parseAuthUsers(getEnv("USERS", "")),
+		UsersFile:               getEnv("USERS_FILE", settings.UsersFile),
+		DownloadAuth:            getEnv("DOWNLOAD_AUTH", settings.DownloadAuth),
+		URLSigningKeys:          getSigningKeysEnv("URL_SIGNING_KEYS", settings.URLSigningKeys),
+		URLSigningMaxLifetime:   getIntEnv("URL_SIGNING_MAX_LIFETIME", settings.URLSigningMaxLifetime),
+		AliasVersions:           getIntEnv("ALIAS_VERSIONS", settings.AliasVersions),
+		IPMinRateLimit:          getIntEnv("IP_MIN_RATE_LIMIT", settings.IPMinRateLimit),
+		IPHourRateLimit:         getIntEnv("IP_HOUR_RATE_LIMIT", settings.IPHourRateLimit),
+		IPDayRateLimit:          getIntEnv("IP_DAY_RATE_LIMIT", settings.IPDayRateLimit),
+		IPMinDownloadRateLimit:  getIntEnv("IP_MIN_DOWNLOAD_RATE_LIMIT", settings.IPMinDownloadRateLimit),
+		IPHourDownloadRateLimit: getIntEnv("IP_HOUR_DOWNLOAD_RATE_LIMIT", settings.IPHourDownloadRateLimit),
+		IPDayDownloadRateLimit:  getIntEnv("IP_DAY_DOWNLOAD_RATE_LIMIT", settings.IPDayDownloadRateLimit),
+		IPMinAuthFailureLimit:   getIntEnv("IP_MIN_AUTH_FAILURE_LIMIT", settings.IPMinAuthFailureLimit),
+		IPHourAuthFailureLimit:  getIntEnv("IP_HOUR_AUTH_FAILURE_LIMIT", settings.IPHourAuthFailureLimit),
+		RateLimitPersist:        getIntEnv("RATE_LIMIT_PERSIST", 0) == 1,
+		TrustedProxies:          getPrefixesEnv("TRUSTED_PROXY_IP", settings.TrustedProxies),
+		// RATE_LIMIT_EXCLUDE_IPS is what .env.example used to call it
+		RateLimitExcludedIPs: getPrefixesEnv("RATE_LIMIT_EXCLUDED_IPS",
+			getPrefixesEnv("RATE_LIMIT_EXCLUDE_IPS", settings.RateLimitExcludedIPs)),
+		RateLimitIPv6Prefix: getIntEnv("RATE_LIMIT_IPV6_PREFIX", settings.RateLimitIPv6Prefix),
+		StorageBackend:      getEnv("STORAGE_BACKEND", settings.StorageBackend),
+		S3: S3Config{
+			Endpoint:  getEnv("S3_ENDPOINT", settings.S3.Endpoint),
+			Bucket:    getEnv("S3_BUCKET", settings.S3.Bucket),
+			AccessKey: getEnv("S3_ACCESS_KEY", settings.S3.AccessKey),
+			SecretKey: getEnv("S3_SECRET_KEY", settings.S3.SecretKey),
+			Region:    getEnv("S3_REGION", settings.S3.Region),
+			UseSSL:    getIntEnv("S3_USE_SSL", 1) == 1,
+			Prefix:    getEnv("S3_PREFIX", settings.S3.Prefix),
+		},
+		ShortnameMode:   getEnv("SHORTNAME_MODE", settings.ShortnameMode),
+		ShortnameLength: getIntEnv("SHORTNAME_LENGTH", settings.ShortnameLength),
+	}
+
+	switch settings.ShortnameMode {
+	case SHORTNAME_MODE_SEQUENTIAL, SHORTNAME_MODE_RANDOM, SHORTNAME_MODE_OBFUSCATED:
+	default:
+		log.Fatalf("Error parsing 'SHORTNAME_MODE'. Expected 'sequential', 'random' or 'obfuscated' but got '%s'", settings.ShortnameMode)
+	}
+	switch settings.DownloadAuth {
+	case DOWNLOAD_AUTH_PUBLIC, DOWNLOAD_AUTH_AUTHENTICATED, DOWNLOAD_AUTH_PER_FILE:
+	default:
+		log.Fatalf("Error parsing 'DOWNLOAD_AUTH'. Expected 'public', 'authenticated' or 'per-file' but got '%s'", settings.DownloadAuth)
+	}
+	if settings.AliasVersions < 1 {
+		log.Fatalf("Error parsing 'ALIAS_VERSIONS'. Expected at least 1 but got %d", settings.AliasVersions)
+	}
+	if settings.RateLimitIPv6Prefix < 1 || settings.RateLimitIPv6Prefix > 128 {
+		log.Fatalf("Error parsing 'RATE_LIMIT_IPV6_PREFIX'. Expected a prefix length between 1 and 128 but got %d", settings.RateLimitIPv6Prefix)
+	}
+	if settings.ShortnameLength < 4 || settings.ShortnameLength > 32 {
+		log.Fatalf("Error parsing 'SHORTNAME_LENGTH'. Expected a length between 4 and 32 but got %d", settings.ShortnameLength)
 	}
 
 	// mkdir -p STORE_PATH
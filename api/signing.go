@@ -0,0 +1,180 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Query parameters of signed URLs
+const (
+	SIGNATURE_EXPIRES_PARAM = "expires"
+	SIGNATURE_KEY_PARAM     = "kid"
+	SIGNATURE_PARAM         = "signature"
+	// Signed along with the path so a link to one version of an alias does not open the others
+	SIGNATURE_VERSION_PARAM = "version"
+)
+
+// Lifetime of signed URLs when the caller does not choose one
+const DEFAULT_SIGNED_URL_LIFETIME = time.Hour
+
+// Shortest secret accepted in URL_SIGNING_KEYS
+const MIN_SIGNING_KEY_LENGTH = 32
+
+var ErrInvalidSignature = errors.New("invalid signature")
+var ErrSignatureExpired = errors.New("this link expired")
+
+type SigningKey struct {
+	// Sent with signed URLs so the key that signed them can be found after others were added
+	ID     string
+	Secret []byte
+}
+
+// Parses a comma separated list of id:secret keys. The first one signs new URLs, all of them are
+// accepted so keys can be rotated by adding a new one in front and removing the old one later
+func ParseSigningKeys(value string) ([]SigningKey, error) {
+	keys := []SigningKey{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(item, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("expected id:secret but got '%s'", item)
+		}
+		if len(secret) < MIN_SIGNING_KEY_LENGTH {
+			return nil, fmt.Errorf("the secret of key '%s' must be at least %d characters long", id, MIN_SIGNING_KEY_LENGTH)
+		}
+		for _, key := range keys {
+			if key.ID == id {
+				return nil, fmt.Errorf("key '%s' is listed twice", id)
+			}
+		}
+		keys = append(keys, SigningKey{ID: id, Secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+func signature(key SigningKey, path string, version string, expires int64) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(path + "\n" + version + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Query parameters letting anyone download path, or the given version of it when not zero, until
+// expires, signed with the first key
+func SignPath(keys []SigningKey, path string, version int64, expires time.Time) (url.Values, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	query := url.Values{}
+	if version != 0 {
+		query.Set(SIGNATURE_VERSION_PARAM, strconv.FormatInt(version, 10))
+	}
+	query.Set(SIGNATURE_EXPIRES_PARAM, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(SIGNATURE_KEY_PARAM, keys[0].ID)
+	query.Set(SIGNATURE_PARAM, signature(keys[0], path, query.Get(SIGNATURE_VERSION_PARAM), expires.Unix()))
+	return query, nil
+}
+
+// Whether the query has the parameters of a signed URL at all
+func IsSigned(query url.Values) bool {
+	return query.Get(SIGNATURE_PARAM) != ""
+}
+
+// Checks the signature of a URL made by SignPath for path
+func VerifySignedPath(keys []SigningKey, path string, query url.Values, now time.Time) error {
+	expires, err := strconv.ParseInt(query.Get(SIGNATURE_EXPIRES_PARAM), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	kid := query.Get(SIGNATURE_KEY_PARAM)
+	for _, key := range keys {
+		if key.ID != kid {
+			continue
+		}
+		if !hmac.Equal([]byte(signature(key, path, query.Get(SIGNATURE_VERSION_PARAM), expires)), []byte(query.Get(SIGNATURE_PARAM))) {
+			return ErrInvalidSignature
+		}
+		if now.Unix() >= expires {
+			return ErrSignatureExpired
+		}
+		return nil
+	}
+	return ErrInvalidSignature
+}
+
+// Mints signed URLs for /:name and /:bucket/*path under /sign. The group is expected to require
+// requireReadPrivate since the URLs let anyone read the file
+func addSigningRoutes(sign *gin.RouterGroup) {
+	handler := func(c *gin.Context) {
+		settings := GetSettings()
+		if len(settings.URLSigningKeys) == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "signed URLs are only available when URL_SIGNING_KEYS is set"})
+			return
+		}
+
+		now := time.Now()
+		expires := now.Add(DEFAULT_SIGNED_URL_LIFETIME)
+		if value := c.Query("expires"); value != "" {
+			var err error
+			if expires, err = ParseExpiry(value, now); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		maxLifetime := time.Duration(settings.URLSigningMaxLifetime) * time.Hour
+		if maxLifetime > 0 && expires.Sub(now) > maxLifetime {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("signed URLs can be valid for %d hours at most", settings.URLSigningMaxLifetime)})
+			return
+		}
+
+		var err error
+		var path string
+		var version int64
+		name, alias := c.Param("name"), strings.TrimPrefix(c.Param("path"), "/")
+		if alias != "" {
+			if version, err = aliasVersion(c); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			_, err = GetDB().findByAlias(name, alias, version)
+			path = "/" + name + "/" + alias
+		} else {
+			_, err = GetDB().findByShortName(name)
+			path = "/" + name
+		}
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		query, err := SignPath(settings.URLSigningKeys, path, version, expires)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		escaped := (&url.URL{Path: path}).EscapedPath()
+		c.JSON(http.StatusOK, gin.H{
+			"url":        fmt.Sprintf("%s%s?%s", getHostUrl(c.Request), escaped, query.Encode()),
+			"expires_at": time.Unix(expires.Unix(), 0).UTC().Format(time.RFC3339),
+		})
+	}
+	sign.POST("/:name", handler)
+	sign.POST("/:name/*path", handler)
+}
@@ -0,0 +1,85 @@
+package api_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matheusfillipe/girafiles/api"
+)
+
+func TestSignedPath(t *testing.T) {
+	t.Parallel()
+
+	old, err := api.ParseSigningKeys("old:" + strings.Repeat("a", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := api.ParseSigningKeys("new:" + strings.Repeat("b", 32) + ", old:" + strings.Repeat("a", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	query, err := api.SignPath(old, "/bucket/file.txt", 0, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !api.IsSigned(query) {
+		t.Fatal("Expected the query to be signed")
+	}
+	if err := api.VerifySignedPath(rotated, "/bucket/file.txt", query, now); err != nil {
+		t.Fatalf("Expected URLs signed by old keys to be accepted after a rotation, got %v", err)
+	}
+	if err := api.VerifySignedPath(rotated, "/bucket/other.txt", query, now); !errors.Is(err, api.ErrInvalidSignature) {
+		t.Fatalf("Expected the signature to only be valid for its path, got %v", err)
+	}
+	if err := api.VerifySignedPath(rotated[:1], "/bucket/file.txt", query, now); !errors.Is(err, api.ErrInvalidSignature) {
+		t.Fatalf("Expected URLs signed by removed keys to be rejected, got %v", err)
+	}
+	if err := api.VerifySignedPath(rotated, "/bucket/file.txt", query, now.Add(time.Hour)); !errors.Is(err, api.ErrSignatureExpired) {
+		t.Fatalf("Expected the URL to expire, got %v", err)
+	}
+
+	query.Set(api.SIGNATURE_VERSION_PARAM, "1")
+	if err := api.VerifySignedPath(rotated, "/bucket/file.txt", query, now); !errors.Is(err, api.ErrInvalidSignature) {
+		t.Fatalf("Expected the signature to only be valid for the current version, got %v", err)
+	}
+	query.Del(api.SIGNATURE_VERSION_PARAM)
+
+	query, err = api.SignPath(old, "/bucket/file.txt", 2, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.VerifySignedPath(rotated, "/bucket/file.txt", query, now); err != nil {
+		t.Fatalf("Expected a signed version to be accepted, got %v", err)
+	}
+	query.Set(api.SIGNATURE_VERSION_PARAM, "1")
+	if err := api.VerifySignedPath(rotated, "/bucket/file.txt", query, now); !errors.Is(err, api.ErrInvalidSignature) {
+		t.Fatalf("Expected a changed version to invalidate the signature, got %v", err)
+	}
+
+	query.Set(api.SIGNATURE_EXPIRES_PARAM, "99999999999")
+	if err := api.VerifySignedPath(rotated, "/bucket/file.txt", query, now); !errors.Is(err, api.ErrInvalidSignature) {
+		t.Fatalf("Expected a changed expiry to invalidate the signature, got %v", err)
+	}
+
+	query, err = api.SignPath(rotated, "/BB.txt", 0, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Get(api.SIGNATURE_KEY_PARAM) != "new" {
+		t.Fatalf("Expected the first key to sign, got %s", query.Get(api.SIGNATURE_KEY_PARAM))
+	}
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	t.Parallel()
+
+	for _, invalid := range []string{"short:secret", strings.Repeat("a", 40), "a:" + strings.Repeat("a", 32) + ",a:" + strings.Repeat("b", 32)} {
+		if _, err := api.ParseSigningKeys(invalid); err == nil {
+			t.Fatalf("Expected '%s' to be rejected", invalid)
+		}
+	}
+}
@@ -1,18 +1,21 @@
 package api
 
 import (
-	"bytes"
-	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
-	"mime/multipart"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gabriel-vasile/mimetype"
 )
@@ -21,340 +24,692 @@ const FILEDIR = "data"
 
 var storageLock = &sync.Mutex{}
 
+// Blobs that uploads are writing or sharing outside of storageLock and did not reference yet, by how
+// many uploads. Guarded by storageLock. They are not deleted even if no row references them anymore.
+var pendingBlobs = map[string]int{}
+
+// Keeps blob from being deleted while it is uploaded or read. Must be called holding storageLock
+func holdBlob(blob string) {
+	pendingBlobs[blob]++
+}
+
+// Must be called holding storageLock
+func unholdBlob(blob string) {
+	if pendingBlobs[blob]--; pendingBlobs[blob] <= 0 {
+		delete(pendingBlobs, blob)
+	}
+}
+
+// Deletes a blob no row references anymore from the storage unless it is held by an upload about to
+// reference it again or by a download. Returns whether it was deleted. Must be called holding storageLock
+func deleteUnusedBlob(blob string) (bool, error) {
+	if pendingBlobs[blob] > 0 {
+		slog.Debug("Keeping unreferenced blob that is being uploaded", "blob", blob)
+		return false, nil
+	}
+	if err := GetStorage().Delete(blob); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// Drops a hold and deletes the blob if the rows referencing it were deleted meanwhile, unless another
+// upload or download holds it. Must be called holding storageLock
+func releaseHeldBlob(blob string) {
+	unholdBlob(blob)
+	referenced, err := GetDB().isBlobReferenced(blob)
+	if err == nil && !referenced {
+		_, err = deleteUnusedBlob(blob)
+	}
+	if err != nil {
+		slog.Error("Failed to remove file", "file", blob, "error", err)
+	}
+}
+
+var ErrFileTooLarge = errors.New("file size limit exceeded")
+var ErrFileEmpty = errors.New("file is empty")
+var ErrInvalidDeleteToken = errors.New("invalid deletion token")
+
+type UploadOptions struct {
+	// When the file should be deleted. Zero to use FILE_PERSISTANCE_TIME
+	ExpiresAt time.Time
+	// Delete the file after it was downloaded this many times. Zero for unlimited
+	MaxDownloads int64
+	// Required to download the file if not empty
+	Password string
+	// Only users and tokens with the read-private scope can download it when DOWNLOAD_AUTH is per-file
+	Private bool
+	// Bucket uploads only. Replace the current version of the alias instead of failing with ErrDuplicateAlias
+	Overwrite bool
+	// Bucket uploads only. If-Match and If-None-Match headers the current version of the alias has to satisfy.
+	// Either one allows replacing it
+	IfMatch     string
+	IfNoneMatch string
+}
+
+type UploadResult struct {
+	Shortname string
+	// Secret allowing the uploader to delete the file
+	DeleteToken string
+	// Zero if the file never expires
+	ExpiresAt time.Time
+	// Zero for unlimited
+	MaxDownloads int64
+	Private      bool
+	// Set when the upload claimed a bucket for the holder of this token
+	BucketToken string
+	// Version of the bucket alias, zero for other uploads
+	Version int64
+}
+
+func newUploadResult(node *Node) UploadResult {
+	row := fileRow{timestamp: node.timestamp, expiresAt: node.expiresAt}
+	return UploadResult{
+		Shortname:    node.shortname,
+		DeleteToken:  node.deleteToken,
+		ExpiresAt:    row.expiry(),
+		MaxDownloads: node.maxDownloads,
+		Private:      node.private,
+		Version:      node.version,
+	}
+}
+
+type FileInfo struct {
+	Mimetype string
+	Size     int64
+	// Zero if the file never expires
+	ExpiresAt time.Time
+	// UNLIMITED_DOWNLOADS if the file is not deleted after a number of downloads
+	DownloadsLeft int64
+	// Password protected files have no Mimetype, Size and OriginalName
+	Locked       bool
+	OriginalName string
+	// Name of the blob the digest headers are derived from
+	blob string
+}
+
 type Node struct {
-	name      string
-	shortname string
-	extension string
-	ip        string
-	timestamp int64
-	reader    io.Reader
+	name         string
+	shortname    string
+	extension    string
+	ip           string
+	timestamp    int64
+	expiresAt    int64
+	maxDownloads int64
+	deleteToken  string
+	passwordHash string
+	originalName string
+	size         int64
+	mimetype     string
+	private      bool
+	version      int64
 }
 
 type fileResponse struct {
 	name      string
 	shortname string
 	mimetype  string
-	content   []byte
+	size      int64
+	modtime   time.Time
+	content   io.ReadSeekCloser
+	row       fileRow
 }
 
-func getFileHash(reader io.Reader) (string, error) {
-	md5Hash := md5.New()
-	_, err := io.Copy(md5Hash, reader)
-	if err != nil {
-		return "", err
+// Closes the content and releases the blob, which is deleted if the file was burned or deleted while
+// it was read and no other file shares it
+func (f fileResponse) Close() {
+	if f.content == nil {
+		return
 	}
-	return fmt.Sprintf("%x", md5Hash.Sum(nil)), nil
+	if err := f.content.Close(); err != nil {
+		slog.Error("Failed to close file", "file", f.name, "error", err)
+	}
+	storageLock.Lock()
+	defer storageLock.Unlock()
+	releaseHeldBlob(f.name)
 }
 
-func newNode(file io.Reader, extension string, ip string) (*Node, error) {
-	hash, err := getFileHash(file)
-	if err != nil {
-		return nil, err
+// Name the file is saved as by browsers
+func (f fileResponse) downloadName() string {
+	if f.row.originalName != "" {
+		return f.row.originalName
 	}
-	return &Node{
-		name:      hash + extension,
-		extension: extension,
-		ip:        ip,
-		timestamp: time.Now().UTC().Unix(),
-		reader:    file,
-	}, nil
+	return f.shortname
 }
 
-func saveToDisk(src io.Reader, filename string, ip string) (string, *Node, error) {
-	var settings = GetSettings()
+// Whether the file needs credentials when DOWNLOAD_AUTH is per-file
+func (f fileResponse) private() bool {
+	return f.row.private
+}
+
+func (f fileResponse) locked() bool {
+	return f.row.passwordHash != ""
+}
 
-	// Create buffer to read multiple times from memory
-	buf, err := io.ReadAll(src)
+// Checks the password of protected files. Must be called before revealing anything about them
+func (f fileResponse) unlock(password string) error {
+	return checkPassword(password, f.row.passwordHash)
+}
+
+// Whether the file is deleted after a number of downloads
+func (f fileResponse) limited() bool {
+	return f.row.downloadsLeft != UNLIMITED_DOWNLOADS
+}
+
+// Counts a download of the content. Must be called before delivering the content of files.
+// The last allowed download removes the file from the database and the blob is deleted on Close.
+func (f *fileResponse) consume() error {
+	if !f.limited() {
+		return nil
+	}
+	db := GetDB()
+	left, err := db.decrementDownloads(f.row.id)
 	if err != nil {
-		return "", nil, err
+		return err
 	}
-	if len(buf) == 0 {
-		return "", nil, fmt.Errorf("File is empty")
+	if left > 0 {
+		return nil
 	}
-	if len(buf)/1024/1024 > settings.FileSizeLimit {
-		return "", nil, fmt.Errorf("File size limit exceeded. Limit is %dMB", settings.FileSizeLimit)
+
+	storageLock.Lock()
+	defer storageLock.Unlock()
+	if _, _, err := db.deleteFileRow(f.row.id); err != nil {
+		return err
 	}
+	slog.Info(fmt.Sprintf("File %s reached its download limit", f.name))
+	return nil
+}
 
-	// Parse file and create node
-	node, err := newNode(bytes.NewReader(buf), filepath.Ext(filename), ip)
-	if err != nil {
-		return "", nil, err
+// Reads the whole content, only meant for small files like pastes
+func (f fileResponse) readAll() ([]byte, error) {
+	return io.ReadAll(f.content)
+}
+
+// An upload that was streamed into a temporary file inside STORE_PATH and is
+// waiting to be committed into the data directory.
+type IncomingFile struct {
+	path     string
+	hash     string
+	size     int64
+	mimetype string
+}
+
+// Removes the temporary file if it was not committed
+func (f *IncomingFile) Discard() {
+	if f == nil || f.path == "" {
+		return
 	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to remove temporary file", "file", f.path, "error", err)
+	}
+	f.path = ""
+}
 
-	// Create data directory if it doesn't exist
-	dir := filepath.Join(settings.StorePath, FILEDIR)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if os.MkdirAll(dir, os.ModePerm) != nil {
-			return "", node, err
-		}
+// Errors once more than limit bytes are read so oversized uploads are aborted
+// as soon as they cross the limit instead of after being fully received.
+type limitedReader struct {
+	r     io.Reader
+	left  int64
+	limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.limit <= 0 {
+		return l.r.Read(p)
 	}
+	if l.left < 0 {
+		return 0, ErrFileTooLarge
+	}
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, ErrFileTooLarge
+	}
+	return n, err
+}
+
+func fileSizeLimitBytes() int64 {
+	return int64(GetSettings().FileSizeLimit) * 1024 * 1024
+}
 
-	// Write file to disk
-	dst := filepath.Join(dir, node.name)
-	out, err := os.Create(dst)
+// Streams src into a temporary file under STORE_PATH computing its hash on the fly.
+// The size limit is enforced while reading.
+func ReceiveFile(src io.Reader) (*IncomingFile, error) {
+	settings := GetSettings()
+
+	out, err := os.CreateTemp(settings.StorePath, ".upload-*")
 	if err != nil {
-		return "", node, err
+		return nil, err
 	}
-	defer func() {
-		if err := out.Close(); err != nil {
-			slog.Error("Failed to close file", "error", err)
+	incoming := &IncomingFile{path: out.Name()}
+
+	hash := sha256.New()
+	limited := &limitedReader{r: src, left: fileSizeLimitBytes(), limit: fileSizeLimitBytes()}
+	size, err := io.Copy(out, io.TeeReader(limited, hash))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		incoming.Discard()
+		if errors.Is(err, ErrFileTooLarge) {
+			return nil, fmt.Errorf("%w. Limit is %dMB", ErrFileTooLarge, settings.FileSizeLimit)
 		}
-	}()
-	_, err = io.Copy(out, bytes.NewReader(buf))
+		return nil, err
+	}
+	if size == 0 {
+		incoming.Discard()
+		return nil, ErrFileEmpty
+	}
+
+	incoming.hash = fmt.Sprintf("%x", hash.Sum(nil))
+	incoming.size = size
+	// Only reads the first few kilobytes
+	m, err := mimetype.DetectFile(incoming.path)
 	if err != nil {
-		return "", node, err
+		incoming.Discard()
+		return nil, err
 	}
-	return dst, node, nil
+	incoming.mimetype = m.String()
+	return incoming, nil
 }
 
-func handleDbUploadErr(err error, dst string, node *Node) (string, error) {
-	db := GetDB()
+// Longest original filename that is kept, in bytes
+const MAX_ORIGINAL_NAME_LENGTH = 255
 
-	// If it fails we also delete the file
-	if err.Error() == DUP_ENTRY_ERROR {
-		shortname, errdb := db.getShortnameForFilename(node.name)
-		if errdb != nil {
-			return "", fmt.Errorf("failed to get filename: %s", errdb.Error())
+// Keeps the last path element of an uploaded filename without control characters
+func cleanOriginalName(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
 		}
-		return shortname, err
-	}
-	if err.Error() == DUP_ALIAS_ERROR {
-		if err := os.Remove(dst); err != nil {
-			slog.Error("Failed to remove file", "file", dst, "error", err)
-		}
-		return node.shortname, fmt.Errorf("this bucket/alias is already in use")
-	}
+		return r
+	}, filename)
+	// Windows clients may send the full path
+	filename = strings.TrimSpace(path.Base(strings.ReplaceAll(filename, "\\", "/")))
+	if filename == "." || filename == "/" {
+		return ""
+	}
+	for len(filename) > MAX_ORIGINAL_NAME_LENGTH {
+		_, size := utf8.DecodeLastRuneInString(filename)
+		filename = filename[:len(filename)-size]
+	}
+	return filename
+}
 
-	if err := os.Remove(dst); err != nil {
-		slog.Error("Failed to remove file", "file", dst, "error", err)
+func newNode(file *IncomingFile, filename string, ip string, options UploadOptions) (*Node, error) {
+	now := time.Now().UTC()
+	extension := filepath.Ext(filename)
+	node := &Node{
+		name:         file.hash + extension,
+		extension:    extension,
+		ip:           ip,
+		timestamp:    now.Unix(),
+		deleteToken:  randomToken(),
+		originalName: cleanOriginalName(filename),
+		size:         file.size,
+		mimetype:     file.mimetype,
+		private:      options.Private,
+	}
+	if !options.ExpiresAt.IsZero() {
+		node.expiresAt = capExpiry(options.ExpiresAt, now).Unix()
+	}
+	if options.MaxDownloads > 0 {
+		node.maxDownloads = options.MaxDownloads
+	}
+	if options.Password != "" {
+		hash, err := hashPassword(options.Password)
+		if err != nil {
+			return nil, err
+		}
+		node.passwordHash = hash
 	}
-	return node.shortname, err
+	return node, nil
 }
 
-func Upload(file *multipart.FileHeader, ip string) (string, error) {
-	storageLock.Lock()
-	defer storageLock.Unlock()
-	db := GetDB()
+// Moves the temporary file into the storage backend without holding storageLock. The blob is held
+// until releaseUploadedBlob so it is not deleted before the upload references it.
+func commitToStorage(file *IncomingFile, node *Node) error {
+	storage := GetStorage()
+
+	for n := 1; ; n++ {
+		storageLock.Lock()
+		holdBlob(node.name)
+		storageLock.Unlock()
 
-	if err := db.CheckRateLimit(ip); err != nil {
-		return "", err
+		_, err := storage.Stat(node.name)
+		if os.IsNotExist(err) {
+			break
+		}
+		// Only an identical blob is shared, a different content with the same hash gets its own name
+		same := false
+		if err == nil {
+			same, err = sameContent(storage, node.name, file.path, file.size)
+		}
+		if err == nil && same {
+			file.Discard()
+			return nil
+		}
+		storageLock.Lock()
+		unholdBlob(node.name)
+		storageLock.Unlock()
+		if err != nil {
+			return err
+		}
+		slog.Warn("Hash collision, storing the upload under another name", "file", node.name)
+		node.name = fmt.Sprintf("%s-%d%s", file.hash, n, node.extension)
 	}
 
-	src, err := file.Open()
+	err := putFile(storage, node.name, file)
 	if err != nil {
-		return "", err
+		storageLock.Lock()
+		unholdBlob(node.name)
+		storageLock.Unlock()
+		return err
+	}
+	file.Discard()
+	return nil
+}
+
+func putFile(storage Storage, name string, file *IncomingFile) error {
+	src, err := os.Open(file.path)
+	if err != nil {
+		return err
 	}
 	defer func() {
 		if err := src.Close(); err != nil {
 			slog.Error("Failed to close file", "error", err)
 		}
 	}()
+	return storage.Put(name, src, file.size)
+}
+
+// Drops the hold of commitToStorage. When the upload failed the blob is deleted unless another row
+// references it or another upload holds it. Must be called holding storageLock
+func releaseUploadedBlob(node *Node, failed bool) {
+	if !failed {
+		unholdBlob(node.name)
+		return
+	}
+	releaseHeldBlob(node.name)
+}
+
+func handleDbUploadErr(err error, node *Node) (UploadResult, error) {
+	releaseUploadedBlob(node, true)
+	return UploadResult{Shortname: node.shortname}, err
+}
 
-	// Upload file to disk
-	dst, node, err := saveToDisk(src, file.Filename, ip)
+func Upload(file *IncomingFile, filename string, ip string, options UploadOptions) (UploadResult, error) {
+	defer file.Discard()
+	db := GetDB()
+
+	node, err := newNode(file, filename, ip, options)
 	if err != nil {
-		return "", err
+		return UploadResult{}, err
+	}
+	if err := commitToStorage(file, node); err != nil {
+		return UploadResult{}, err
 	}
 
+	// Only referencing the blob needs the lock, writing it can take long
+	storageLock.Lock()
+	defer storageLock.Unlock()
+
 	// Write node to database
 	err = db.insertNode(node)
 	if err != nil {
-		return handleDbUploadErr(err, dst, node)
+		return handleDbUploadErr(err, node)
 	}
-	return node.shortname, err
+	releaseUploadedBlob(node, false)
+	KickJanitor()
+	return newUploadResult(node), nil
 }
 
-func UploadToBucket(src io.Reader, ip string, bucket string, name string) (string, error) {
-	storageLock.Lock()
-	defer storageLock.Unlock()
+// Uploads the next version of bucket/name. Returns ErrBucketForbidden if the bucket was claimed by someone
+// else than access, ErrDuplicateAlias or ErrPreconditionFailed if options do not allow replacing the current version
+func UploadToBucket(file *IncomingFile, ip string, bucket string, name string, options UploadOptions, access BucketAccess) (UploadResult, error) {
+	defer file.Discard()
 	db := GetDB()
 
-	if err := db.CheckRateLimit(ip); err != nil {
-		return "", err
+	// Refuse uploads to buckets of others before storing anything, checked again below
+	if row, err := db.findBucket(bucket); err == nil && !access.owns(row) {
+		return UploadResult{}, ErrBucketForbidden
 	}
+	node, err := newNode(file, name, ip, options)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	if err := commitToStorage(file, node); err != nil {
+		return UploadResult{}, err
+	}
+
+	storageLock.Lock()
+	defer storageLock.Unlock()
 
-	// Upload file to disk
-	dst, node, err := saveToDisk(src, name, ip)
+	bucketToken, release, err := claimBucket(bucket, access)
 	if err != nil {
-		return "", err
+		return handleDbUploadErr(err, node)
+	}
+	current, err := db.findByAlias(bucket, name, 0)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		release()
+		return handleDbUploadErr(err, node)
+	}
+	if err := checkAliasWrite(options, current, err == nil); err != nil {
+		release()
+		return handleDbUploadErr(err, node)
 	}
 
 	// Write node to database
 	err = db.insertAlias(bucket, name, node)
 	if err != nil {
-		return handleDbUploadErr(err, dst, node)
+		release()
+		return handleDbUploadErr(err, node)
+	}
+	releaseUploadedBlob(node, false)
+	pruneAliasVersions(bucket, name, node.version)
+	KickJanitor()
+	result := newUploadResult(node)
+	result.BucketToken = bucketToken
+	return result, nil
+}
+
+// Removes the database row and the blob once nothing else references it.
+// Without authorization the deletion token handed out on upload is required.
+func deleteRow(row fileRow, token string, authorized bool) error {
+	if !authorized && !checkToken(token, row.deleteToken) {
+		return ErrInvalidDeleteToken
+	}
+
+	blob, unused, err := GetDB().deleteFileRow(row.id)
+	if err != nil {
+		return err
 	}
-	return node.shortname, err
+	if unused {
+		if _, err := deleteUnusedBlob(blob); err != nil {
+			return err
+		}
+	}
+	slog.Info(fmt.Sprintf("Deleted file %s on request", row.filename))
+	return nil
 }
 
-func loadFromDisk(name string, shortname string) (fileResponse, error) {
-	settings := GetSettings()
+func Delete(n string, token string, authorized bool) error {
+	storageLock.Lock()
+	defer storageLock.Unlock()
 
-	name = strings.SplitN(name, "@", 2)[0]
+	row, err := GetDB().findByShortName(n)
+	if err != nil {
+		return err
+	}
+	return deleteRow(row, token, authorized)
+}
 
-	dst := filepath.Join(settings.GetFileStoragePath(), name)
-	b, err := os.ReadFile(dst)
+// Deletes a version of bucket/alias, the current one if version is zero. The previous version becomes the current one
+func DeleteFromBucket(bucket string, alias string, version int64, token string, authorized bool) error {
+	storageLock.Lock()
+	defer storageLock.Unlock()
 
+	row, err := GetDB().findByAlias(bucket, alias, version)
+	if err != nil {
+		return err
+	}
+	return deleteRow(row, token, authorized)
+}
+
+// Finds a row with find and holds its blob, so it can be read without storageLock. Release it with
+// fileResponse.Close
+func findAndHold(find func(db *DBHelper) (fileRow, error)) (fileRow, error) {
+	storageLock.Lock()
+	defer storageLock.Unlock()
+	row, err := find(GetDB())
+	if err != nil {
+		return row, err
+	}
+	holdBlob(row.filename)
+	return row, nil
+}
+
+// Opens the blob of a row held by findAndHold. The hold is released if it fails
+func loadFromStorage(row fileRow, shortname string) (fileResponse, error) {
+	name := row.filename
+
+	content, info, err := GetStorage().Get(name)
 	if err != nil {
 		log.Println(err)
+		storageLock.Lock()
+		releaseHeldBlob(name)
+		storageLock.Unlock()
 		return fileResponse{}, err
 	}
-	m := mimetype.Detect(b).String()
-
-	return fileResponse{
+	response := fileResponse{
 		shortname: shortname,
 		name:      name,
-		mimetype:  m,
-		content:   b,
-	}, nil
+		size:      info.Size,
+		modtime:   info.ModTime,
+		content:   content,
+		row:       row,
+	}
+
+	_, response.mimetype, err = GetDB().blobInfo(name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		response.Close()
+		return fileResponse{}, err
+	}
+	if response.mimetype != "" {
+		return response, nil
+	}
+
+	m, err := mimetype.DetectReader(content)
+	if err != nil {
+		response.Close()
+		return fileResponse{}, err
+	}
+	response.mimetype = m.String()
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		response.Close()
+		return fileResponse{}, err
+	}
+	return response, nil
 }
 
+// Opens a file. Callers delivering its content must call consume first
 func Download(n string) (fileResponse, error) {
-	storageLock.Lock()
-	defer storageLock.Unlock()
-
-	name, err := GetDB().checkShortName(n)
+	row, err := findAndHold(func(db *DBHelper) (fileRow, error) { return db.findByShortName(n) })
 	if err != nil {
 		log.Println(err)
 		return fileResponse{}, err
 	}
 
-	return loadFromDisk(name, n)
+	return loadFromStorage(row, n)
 }
 
-func DownloadFromBucket(bucket string, alias string) (fileResponse, error) {
-	storageLock.Lock()
-	defer storageLock.Unlock()
-
-	name, err := GetDB().checkAlias(bucket, alias)
+// Opens a version of bucket/alias, the current one if version is zero
+func DownloadFromBucket(bucket string, alias string, version int64) (fileResponse, error) {
+	row, err := findAndHold(func(db *DBHelper) (fileRow, error) { return db.findByAlias(bucket, alias, version) })
 	if err != nil {
 		log.Println(err)
 		return fileResponse{}, err
 	}
-	return loadFromDisk(name, alias)
+	response, err := loadFromStorage(row, alias)
+	response.mimetype = MimetypeByExtension(response.mimetype, alias)
+	return response, err
 }
 
+// Mime type and size of a blob as stored in the database. Blobs from before mime types were stored
+// are read from the storage
 func getMimeAndSize(name string) (string, int64, error) {
-	settings := GetSettings()
-	name = strings.SplitN(name, "@", 2)[0]
-	dst := filepath.Join(settings.GetFileStoragePath(), name)
-
-	info, err := os.Stat(dst)
-	if err != nil {
-		return "", 0, err
+	size, mime, err := GetDB().blobInfo(name)
+	if err != nil || mime != "" {
+		return mime, size, err
 	}
 
-	f, err := os.Open(dst)
+	content, info, err := GetStorage().Get(name)
 	if err != nil {
 		return "", 0, err
 	}
 	defer func() {
-		if err := f.Close(); err != nil {
+		if err := content.Close(); err != nil {
 			slog.Error("Failed to close file", "error", err)
 		}
 	}()
 
-	m, err := mimetype.DetectReader(f)
-	if err != nil {
-		return "", info.Size(), err
-	}
-	return m.String(), info.Size(), nil
-}
-
-func GetMimeInfo(n string) (string, int64, error) {
-	storageLock.Lock()
-	defer storageLock.Unlock()
-	name, err := GetDB().checkShortName(n)
+	m, err := mimetype.DetectReader(content)
 	if err != nil {
-		return "", 0, err
+		return "", info.Size, err
 	}
-	return getMimeAndSize(name)
+	return m.String(), info.Size, nil
 }
 
-func GetMimeInfoFromBucket(bucket, alias string) (string, int64, error) {
-	storageLock.Lock()
-	defer storageLock.Unlock()
-	name, err := GetDB().checkAlias(bucket, alias)
+// Returns ErrPasswordRequired for password protected files
+func GetMimeInfo(n string) (FileInfo, error) {
+	row, err := GetDB().findByShortName(n)
 	if err != nil {
-		return "", 0, err
+		return FileInfo{}, err
 	}
-	return getMimeAndSize(name)
+	return getUnlockedMimeInfo(row)
 }
 
-func isStorageLimitExceeded() bool {
-	settings := GetSettings()
-
-	if settings.StorePathSizeLimit == 0 {
-		return false
+func getUnlockedMimeInfo(row fileRow) (FileInfo, error) {
+	if row.passwordHash != "" {
+		return FileInfo{}, ErrPasswordRequired
 	}
-	var size int64 = 0
-	err := filepath.Walk(settings.GetFileStoragePath(), func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			if os.IsNotExist(err) {
-				return nil
-			}
-			return err
-		}
-		size += info.Size()
-		return nil
-	})
+	mime, size, err := getMimeAndSize(row.filename)
 	if err != nil {
-		log.Fatal(err)
+		return FileInfo{}, err
 	}
-	slog.Debug(fmt.Sprintf("Storage size: %dMB > %dMB", size/1024/1024, settings.StorePathSizeLimit))
-	return size/1024/1024 > int64(settings.StorePathSizeLimit)
+	return FileInfo{Mimetype: mime, Size: size, blob: row.filename}, nil
 }
 
-// Handle storage size after upload requests
-func cleanup() {
-	storageLock.Lock()
-	defer storageLock.Unlock()
-
-	settings := GetSettings()
-	cdb := GetDB()
-	slog.Info("Checking what we can delete")
-
-	// Delete expired files
-	namesToDelete, err := cdb.deleteExpiredFiles()
+func GetFileInfo(n string) (FileInfo, error) {
+	row, err := GetDB().findByShortName(n)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error deleting expired files: %s", err))
+		return FileInfo{}, err
 	}
-	if len(namesToDelete) == 0 {
-		slog.Debug("No expired files to delete")
+	if row.passwordHash != "" {
+		return FileInfo{ExpiresAt: row.expiry(), DownloadsLeft: row.downloadsLeft, Locked: true}, nil
 	}
-	for _, name := range namesToDelete {
-		err := os.Remove(filepath.Join(settings.GetFileStoragePath(), name))
-		if err != nil {
-			slog.Error(fmt.Sprintf("Error deleting file %s: %s", name, err))
-			continue
-		}
-		slog.Info(fmt.Sprintf("Deleted file %s because it expired", name))
+	mime, size, err := getMimeAndSize(row.filename)
+	if err != nil {
+		return FileInfo{}, err
 	}
+	return FileInfo{Mimetype: mime, Size: size, ExpiresAt: row.expiry(), DownloadsLeft: row.downloadsLeft, OriginalName: row.originalName}, nil
+}
 
-	// Delete oldest file if storage limit is exceeded
-	if isStorageLimitExceeded() {
-		namesToDelete, err := cdb.deleteOldestFiles(1)
-		if err != nil {
-			slog.Error(fmt.Sprintf("Error deleting oldest files from database: %s", err))
-			return
-		}
-		if len(namesToDelete) == 0 {
-			slog.Debug("No old files to delete")
-		}
-		for _, name := range namesToDelete {
-			err := os.Remove(filepath.Join(settings.GetFileStoragePath(), name))
-			if err != nil {
-				slog.Error(fmt.Sprintf("Error deleting file %s: %s", name, err))
-				continue
-			}
-			slog.Info(fmt.Sprintf("Deleted file %s because storage limit was exceeded", name))
-		}
-	} else {
-		slog.Debug("Storage limit not exceeded")
+func GetMimeInfoFromBucket(bucket, alias string, version int64) (FileInfo, error) {
+	row, err := GetDB().findByAlias(bucket, alias, version)
+	if err != nil {
+		return FileInfo{}, err
 	}
+	info, err := getUnlockedMimeInfo(row)
+	info.Mimetype = MimetypeByExtension(info.Mimetype, alias)
+	return info, err
 }
 
-func humanReadableSize(size int) string {
+func humanReadableSize(size int64) string {
 	if size < 1000 {
 		return fmt.Sprintf("%d B", size)
 	}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+const TOKEN_BYTES = 24
+
+// Random hex encoded secret
+func randomToken() string {
+	b := make([]byte, TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Tokens are random enough that a plain SHA-256 is fine to store them
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Compares a token against a stored hash in constant time
+func checkToken(token string, hash string) bool {
+	if token == "" || hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(hash)) == 1
+}
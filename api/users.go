@@ -0,0 +1,324 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PASSWORD_HASH_BCRYPT   = "bcrypt"
+	PASSWORD_HASH_ARGON2ID = "argon2id"
+	// Only checked, new hashes use argon2id
+	PASSWORD_HASH_ARGON2I = "argon2i"
+)
+
+// Parameters of new argon2id hashes, the ones recommended by RFC 9106 for memory constrained setups
+const (
+	ARGON2_TIME    = 3
+	ARGON2_MEMORY  = 64 * 1024
+	ARGON2_THREADS = 4
+	ARGON2_KEY_LEN = 32
+	ARGON2_SALT    = 16
+)
+
+var ErrUnsupportedHash = errors.New("unsupported password hash, expected bcrypt or argon2")
+var ErrUnknownUser = errors.New("unknown user")
+
+// htpasswd style file of user:hash lines. Lines starting with # are comments
+type UsersFile struct {
+	path  string
+	lock  sync.Mutex
+	users map[string]string
+	// Of the file when users was loaded
+	modTime time.Time
+	size    int64
+	// Passwords that matched the hash of their user, so it is not computed on every request.
+	// Emptied when the file changes
+	verified map[string]verifiedPassword
+	// Keys the password MACs in verified, random per process
+	cacheKey []byte
+}
+
+type verifiedPassword struct {
+	hash string
+	mac  []byte
+}
+
+func NewUsersFile(path string) *UsersFile {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &UsersFile{path: path, users: map[string]string{}, verified: map[string]verifiedPassword{}, cacheKey: key}
+}
+
+// Only a MAC of the password is kept in memory
+func (f *UsersFile) passwordMAC(user string, password string) []byte {
+	mac := hmac.New(sha256.New, f.cacheKey)
+	mac.Write([]byte(user + "\x00" + password))
+	return mac.Sum(nil)
+}
+
+// Loads the file again if it changed since the last call. A missing file has no users
+func (f *UsersFile) reload() error {
+	info, err := os.Stat(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		f.users, f.modTime, f.size = map[string]string{}, time.Time{}, 0
+		f.verified = map[string]verifiedPassword{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size && f.users != nil {
+		return nil
+	}
+
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	users := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			slog.Error(fmt.Sprintf("%s:%d: expected user:hash, the line is ignored", f.path, n))
+			continue
+		}
+		if _, err := passwordHashKind(hash); err != nil {
+			slog.Error(fmt.Sprintf("%s:%d: %s, user '%s' is ignored", f.path, n, err, user))
+			continue
+		}
+		users[user] = hash
+	}
+	f.users, f.modTime, f.size = users, info.ModTime(), info.Size()
+	f.verified = map[string]verifiedPassword{}
+	return nil
+}
+
+// Checks the password of user, reloading the file first if it changed. The last password that matched
+// is remembered per user, so clients sending it with every request only pay for hashing once
+func (f *UsersFile) Authenticate(user string, password string) bool {
+	mac := f.passwordMAC(user, password)
+	f.lock.Lock()
+	if err := f.reload(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to read USERS_FILE: %s", err))
+	}
+	hash, exists := f.users[user]
+	verified, cached := f.verified[user]
+	f.lock.Unlock()
+
+	if !exists {
+		return false
+	}
+	if cached && verified.hash == hash && hmac.Equal(verified.mac, mac) {
+		return true
+	}
+	ok, err := checkUserPassword(password, hash)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to check the password of '%s': %s", user, err))
+	}
+	if ok {
+		f.lock.Lock()
+		// Unless the file changed while hashing
+		if f.users[user] == hash {
+			f.verified[user] = verifiedPassword{hash: hash, mac: mac}
+		}
+		f.lock.Unlock()
+	}
+	return ok
+}
+
+// Names of the users in the file, sorted
+func (f *UsersFile) Users() ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	users := []string{}
+	for user := range f.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// Adds user or changes its password. kind is PASSWORD_HASH_BCRYPT or PASSWORD_HASH_ARGON2ID
+func (f *UsersFile) SetPassword(user string, password string, kind string) error {
+	if user == "" || strings.ContainsAny(user, ":\n") || strings.HasPrefix(user, "#") {
+		return fmt.Errorf("invalid user name '%s'", user)
+	}
+	hash, err := hashUserPassword(password, kind)
+	if err != nil {
+		return err
+	}
+	return f.rewrite(user, user+":"+hash)
+}
+
+// Returns ErrUnknownUser if user is not in the file
+func (f *UsersFile) Remove(user string) error {
+	return f.rewrite(user, "")
+}
+
+// Replaces the line of user, appending replacement if there was none. Other lines are kept as they are.
+// An empty replacement removes the user
+func (f *UsersFile) rewrite(user string, replacement string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	content, err := os.ReadFile(f.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	lines := []string{}
+	found := false
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		if name, _, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && name == user {
+			found = true
+			if replacement != "" {
+				lines = append(lines, replacement)
+			}
+			continue
+		}
+		if line != "" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	if !found {
+		if replacement == "" {
+			return fmt.Errorf("%w '%s'", ErrUnknownUser, user)
+		}
+		lines = append(lines, replacement)
+	}
+
+	// Written next to the file and renamed so the server never reads half of it
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+	f.users = nil
+	return nil
+}
+
+func passwordHashKind(hash string) (string, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return PASSWORD_HASH_BCRYPT, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return PASSWORD_HASH_ARGON2ID, nil
+	case strings.HasPrefix(hash, "$argon2i$"):
+		return PASSWORD_HASH_ARGON2I, nil
+	}
+	return "", ErrUnsupportedHash
+}
+
+func hashUserPassword(password string, kind string) (string, error) {
+	if password == "" {
+		return "", errors.New("the password can not be empty")
+	}
+	switch kind {
+	case PASSWORD_HASH_BCRYPT:
+		return hashPassword(password)
+	case PASSWORD_HASH_ARGON2ID:
+		salt := make([]byte, ARGON2_SALT)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, ARGON2_KEY_LEN)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, ARGON2_MEMORY, ARGON2_TIME, ARGON2_THREADS,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	return "", fmt.Errorf("unknown hash '%s'. Expected %s or %s", kind, PASSWORD_HASH_BCRYPT, PASSWORD_HASH_ARGON2ID)
+}
+
+// Compares password with a bcrypt or argon2 hash in the PHC string format
+func checkUserPassword(password string, hash string) (bool, error) {
+	kind, err := passwordHashKind(hash)
+	if err != nil {
+		return false, err
+	}
+	if kind == PASSWORD_HASH_BCRYPT {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+	}
+
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, ErrUnsupportedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version '%s'", parts[2])
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, fmt.Errorf("invalid argon2 parameters '%s'", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	var key []byte
+	if kind == PASSWORD_HASH_ARGON2ID {
+		key = argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+	} else {
+		key = argon2.Key([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+var usersFileOnce sync.Once
+var usersFile *UsersFile
+
+// USERS_FILE, nil if it is not set
+func GetUsersFile() *UsersFile {
+	usersFileOnce.Do(func() {
+		if path := GetSettings().UsersFile; path != "" {
+			usersFile = NewUsersFile(path)
+		}
+	})
+	return usersFile
+}
@@ -0,0 +1,83 @@
+package api_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matheusfillipe/girafiles/api"
+)
+
+func TestUsersFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "users")
+	users := api.NewUsersFile(path)
+	if users.Authenticate("alice", "") {
+		t.Fatal("Expected nobody to be authenticated without the file")
+	}
+
+	if err := users.SetPassword("alice", "secret", api.PASSWORD_HASH_BCRYPT); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SetPassword("bob", "hunter2", api.PASSWORD_HASH_ARGON2ID); err != nil {
+		t.Fatal(err)
+	}
+	if !users.Authenticate("alice", "secret") || !users.Authenticate("bob", "hunter2") {
+		t.Fatal("Expected bcrypt and argon2id passwords to be accepted")
+	}
+	if users.Authenticate("alice", "hunter2") || users.Authenticate("bob", "secret") || users.Authenticate("carol", "secret") {
+		t.Fatal("Expected wrong passwords and unknown users to be rejected")
+	}
+
+	// Changes made by others, like htpasswd -B which writes $2y$ hashes, are picked up
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := strings.SplitN(string(content), "\n", 2)[0]
+	carol := strings.Replace(strings.Replace(alice, "alice:", "carol:", 1), "$2a$", "$2y$", 1)
+	extra := "# comment\ncarol_md5:$apr1$abc$def\n" + carol + "\n"
+	if err := os.WriteFile(path, append(content, []byte(extra)...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !users.Authenticate("carol", "secret") {
+		t.Fatal("Expected the file to be reloaded")
+	}
+	if users.Authenticate("carol_md5", "") {
+		t.Fatal("Expected unsupported hashes to be ignored")
+	}
+
+	if err := users.SetPassword("alice", "changed", api.PASSWORD_HASH_ARGON2ID); err != nil {
+		t.Fatal(err)
+	}
+	if users.Authenticate("alice", "secret") || !users.Authenticate("alice", "changed") {
+		t.Fatal("Expected the password to be changed")
+	}
+	if err := users.Remove("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Remove("bob"); !errors.Is(err, api.ErrUnknownUser) {
+		t.Fatalf("Expected removing bob twice to fail, got %v", err)
+	}
+	list, err := users.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(list, ",") != "alice,carol" {
+		t.Fatalf("Expected alice and carol to be left, got %v", list)
+	}
+
+	content, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "# comment\n") {
+		t.Fatal("Expected comments to be kept")
+	}
+	if err := users.SetPassword("dave:x", "secret", api.PASSWORD_HASH_BCRYPT); err == nil {
+		t.Fatal("Expected names with colons to be rejected")
+	}
+}
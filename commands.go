@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matheusfillipe/girafiles/api"
+	"golang.org/x/term"
+)
+
+const COMMANDS_USAGE = `Usage: girafiles [command]
+
+Without a command the server is started.
+
+Commands:
+  fsck [--repair] [--skip-hash] [--json]   Check that the database and the stored files agree
+  migrate status                           Show which database migrations were applied
+  migrate up                               Apply the pending database migrations
+  token create --name NAME --scopes SCOPES [--expires DURATION]
+                                           Create an API token. Scopes: upload,delete,read-private,admin
+  token list                               List the API tokens
+  token revoke ID                          Revoke an API token
+  user add|passwd NAME [--argon2]          Add a user to USERS_FILE or change its password. The password
+                                           is prompted for or read from stdin
+  user remove NAME                         Remove a user from USERS_FILE
+`
+
+// Runs a command line subcommand and returns the exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "fsck":
+		return fsck(args)
+	case "migrate":
+		return migrate(args)
+	case "token":
+		return token(args)
+	case "user":
+		return user(args)
+	case "help", "-h", "--help":
+		fmt.Print(COMMANDS_USAGE)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n%s", name, COMMANDS_USAGE)
+	return 2
+}
+
+// Exits with 1 if problems were found and not repaired
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix the problems found. Files whose contents are missing or corrupted are deleted")
+	skipHash := flags.Bool("skip-hash", false, "only hash files whose size does not match")
+	asJson := flags.Bool("json", false, "print the report as json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	api.SetupDatabase()
+	report := api.Fsck(api.FsckOptions{Repair: *repair, SkipHash: *skipHash})
+
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	} else {
+		for _, problem := range report.Problems {
+			fmt.Println(problem)
+		}
+		for _, err := range report.Errors {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		fmt.Printf("Checked %d stored files, %d blobs and %d files in %s: %d problems, %d not repaired\n",
+			report.Objects, report.Blobs, report.Files, report.Duration, len(report.Problems), report.Unrepaired())
+		if !*repair && len(report.Problems) > 0 {
+			fmt.Println("Run with --repair to fix them")
+		}
+	}
+
+	if report.Unrepaired() > 0 || len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func migrate(args []string) int {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		fmt.Fprint(os.Stderr, COMMANDS_USAGE)
+		return 2
+	}
+	db := api.GetDB()
+
+	if args[0] == "up" {
+		applied, err := db.Migrate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+		return 0
+	}
+
+	migrations, err := db.Migrations()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	pending := 0
+	for _, migration := range migrations {
+		state := "pending"
+		if migration.AppliedAt != nil {
+			state = "applied " + migration.AppliedAt.Format(time.RFC3339)
+		} else {
+			pending++
+		}
+		fmt.Printf("%4d %-30s %s\n", migration.Version, migration.Name, state)
+	}
+	fmt.Printf("%d pending migrations\n", pending)
+	return 0
+}
+
+func token(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, COMMANDS_USAGE)
+		return 2
+	}
+	api.SetupDatabase()
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("token create", flag.ContinueOnError)
+		name := flags.String("name", "", "what the token is for")
+		scopes := flags.String("scopes", "", "comma separated scopes: "+strings.Join(api.SCOPES, ","))
+		expires := flags.String("expires", "", "when the token expires, a duration like 30d or an RFC 3339 time. Never by default")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		parsedScopes, err := api.ParseScopes(*scopes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 2
+		}
+		var expiresAt time.Time
+		if *expires != "" {
+			if expiresAt, err = api.ParseExpiry(*expires, time.Now()); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				return 2
+			}
+		}
+		created, secret, err := api.CreateApiToken(*name, parsedScopes, expiresAt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		fmt.Printf("Created token %d. It is only shown once:\n%s\n", created.ID, secret)
+		return 0
+
+	case "list":
+		tokens, err := api.ApiTokens()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		for _, t := range tokens {
+			expires := "never expires"
+			if t.ExpiresAt != nil {
+				expires = "expires " + t.ExpiresAt.Format(time.RFC3339)
+			}
+			lastUsed := "never used"
+			if t.LastUsedAt != nil {
+				lastUsed = "last used " + t.LastUsedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d %-20s %-32s %s, %s\n", t.ID, t.Name, strings.Join(t.Scopes, ","), expires, lastUsed)
+		}
+		fmt.Printf("%d tokens\n", len(tokens))
+		return 0
+
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, COMMANDS_USAGE)
+			return 2
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: expected a numeric token id but got '%s'\n", args[1])
+			return 2
+		}
+		if err := api.RevokeApiToken(id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				fmt.Fprintf(os.Stderr, "error: there is no token %d\n", id)
+			} else {
+				fmt.Fprintln(os.Stderr, "error:", err)
+			}
+			return 1
+		}
+		fmt.Printf("Revoked token %d\n", id)
+		return 0
+	}
+	fmt.Fprint(os.Stderr, COMMANDS_USAGE)
+	return 2
+}
+
+func user(args []string) int {
+	if len(args) < 2 || (args[0] != "add" && args[0] != "passwd" && args[0] != "remove") {
+		fmt.Fprint(os.Stderr, COMMANDS_USAGE)
+		return 2
+	}
+	flags := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	useArgon2 := flags.Bool("argon2", false, "hash the password with argon2id instead of bcrypt")
+	if err := flags.Parse(args[2:]); err != nil {
+		return 2
+	}
+	name := args[1]
+	users := api.GetUsersFile()
+	if users == nil {
+		fmt.Fprintln(os.Stderr, "error: USERS_FILE is not set")
+		return 2
+	}
+
+	if args[0] == "remove" {
+		if err := users.Remove(name); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		fmt.Printf("Removed user '%s'\n", name)
+		return 0
+	}
+
+	existing, err := users.Users()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	exists := slices.Contains(existing, name)
+	if args[0] == "add" && exists {
+		fmt.Fprintf(os.Stderr, "error: user '%s' already exists, use passwd to change the password\n", name)
+		return 1
+	}
+	if args[0] == "passwd" && !exists {
+		fmt.Fprintf(os.Stderr, "error: unknown user '%s'\n", name)
+		return 1
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	kind := api.PASSWORD_HASH_BCRYPT
+	if *useArgon2 {
+		kind = api.PASSWORD_HASH_ARGON2ID
+	}
+	if err := users.SetPassword(name, password, kind); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Printf("Saved the password of '%s'\n", name)
+	return 0
+}
+
+// Prompts twice without echo on a terminal, otherwise reads the first line of stdin
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(repeated) {
+		return "", errors.New("the passwords do not match")
+	}
+	return string(password), nil
+}
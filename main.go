@@ -2,6 +2,7 @@ package main
 
 import (
 	"log/slog"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/matheusfillipe/girafiles/api"
@@ -14,5 +15,8 @@ func main() {
 	} else {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 	api.StartServer()
 }
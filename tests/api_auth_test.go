@@ -3,19 +3,24 @@ package tests
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
 	"testing"
 )
 
 func TestAuthentication(t *testing.T) {
 	ctx := context.Background()
 	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{
-		"FILE_PERSISTANCE_TIME": "10",
-		"FILE_SIZE_LIMIT":       "10",
-		"STORE_PATH_SIZE_LIMIT": "50",
-		"IP_MIN_RATE_LIMIT":     "3",
-		"IP_HOUR_RATE_LIMIT":    "6",
-		"IP_DAY_RATE_LIMIT":     "10",
-		"USERS":                 "user1:pass1,user2:pass2",
+		"FILE_PERSISTANCE_TIME":     "10",
+		"FILE_SIZE_LIMIT":           "10",
+		"STORE_PATH_SIZE_LIMIT":     "50",
+		"IP_MIN_RATE_LIMIT":         "3",
+		"IP_HOUR_RATE_LIMIT":        "6",
+		"IP_DAY_RATE_LIMIT":         "10",
+		"USERS":                     "user1:pass1,user2:pass2",
+		"IP_MIN_AUTH_FAILURE_LIMIT": "2",
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -55,4 +60,78 @@ func TestAuthentication(t *testing.T) {
 	if _, ok := j["url"]; !ok {
 		t.Fatalf("Expected url to exist. Response was: %v", j)
 	}
+
+	// Too many failed attempts stop the credentials from being checked at all
+	headers = map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("user1:wrongpass"))}
+	jerr = uploadFile(t, baseUrl+"/api/", strings.NewReader("content"), true, headers)
+	if jerr["error"] != "Unauthorized" {
+		t.Fatalf("Expected error to be Unauthorized. Response was: %v", jerr)
+	}
+	headers = map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("user1:pass1"))}
+	jerr = uploadFile(t, baseUrl+"/api/", strings.NewReader("content"), true, headers)
+	if !strings.Contains(jerr["error"], "too many failed authentication attempts") {
+		t.Fatalf("Expected failed authentication attempts to be limited. Response was: %v", jerr)
+	}
+}
+
+// Users can sign links to files that need credentials
+func TestSignedUrls(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{
+		"USERS":            "user1:pass1",
+		"DOWNLOAD_AUTH":    "authenticated",
+		"URL_SIGNING_KEYS": "k1:" + strings.Repeat("s", 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	authorization := "Basic " + base64.StdEncoding.EncodeToString([]byte("user1:pass1"))
+	j := uploadFile(t, baseUrl+"/api/", strings.NewReader("signed content"), false, map[string]string{"Authorization": authorization})
+	fileUrl, ok := j["url"]
+	if !ok {
+		t.Fatalf("Expected url to exist. Response was: %v", j)
+	}
+	name := strings.TrimPrefix(fileUrl, baseUrl+"/")
+
+	request := func(method string, url string, authorization string) (int, []byte) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+
+	if status, _ := request(http.MethodGet, fileUrl, ""); status != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d without credentials but got %d", http.StatusUnauthorized, status)
+	}
+	if status, _ := request(http.MethodPost, baseUrl+"/api/sign/"+name, ""); status != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d signing without credentials but got %d", http.StatusUnauthorized, status)
+	}
+
+	status, body := request(http.MethodPost, baseUrl+"/api/sign/"+name+"?expires=10m", authorization)
+	if status != http.StatusOK {
+		t.Fatalf("Expected a user to sign the file, got %d %s", status, body)
+	}
+	var signed map[string]string
+	if err := json.Unmarshal(body, &signed); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := request(http.MethodGet, signed["url"], ""); status != http.StatusOK || string(body) != "signed content" {
+		t.Fatalf("Expected the signed URL to download the file, got %d %s", status, body)
+	}
 }
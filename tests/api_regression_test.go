@@ -5,7 +5,6 @@ import (
 	"context"
 	"io"
 	"net/http"
-	"strings"
 	"testing"
 )
 
@@ -60,22 +59,28 @@ func TestRegression(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Duplicates should not be renewed
+	// Uploading the same content again gets a new entry of its own
 	j = uploadFile(t, baseUrl+"/api/", bytes.NewReader(dupBuf.Bytes()), false, nil)
-	if _, ok := j["url"]; !ok {
+	renewedUrl, ok := j["url"]
+	if !ok {
 		dumpContainerLogs(t, apiContainer)
 		t.Fatalf("Expected url to exist. Response was: %v", j)
 	}
-	msg, ok := j["message"]
-	if !ok {
-		dumpContainerLogs(t, apiContainer)
-		t.Fatalf("Expected message to exist. Response was: %v", j)
+	if renewedUrl == dupUrl {
+		t.Fatalf("Expected a new url for the duplicate. Response was: %v", j)
 	}
-	if !strings.Contains(msg, "exists") {
-		dumpContainerLogs(t, apiContainer)
-		t.Fatalf("Expected message to contain 'exists'. Response was: %v", j)
+	if _, ok := j["message"]; ok {
+		t.Fatalf("Expected no message for a duplicate. Response was: %v", j)
+	}
+	respBytes, err := io.ReadAll(getFile(t, renewedUrl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dupBuf.Bytes(), respBytes) {
+		t.Fatalf("Expected the duplicate to have the same content")
 	}
 
+	// The previous upload of it is not renewed
 	resp, err = http.Get(dupUrl)
 	if err != nil {
 		t.Fatal(err)
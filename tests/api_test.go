@@ -3,9 +3,18 @@ package tests
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/matheusfillipe/girafiles/api"
 )
 
 func TestApi(t *testing.T) {
@@ -14,9 +23,10 @@ func TestApi(t *testing.T) {
 		"FILE_PERSISTANCE_TIME": "1",
 		"FILE_SIZE_LIMIT":       "10",
 		"STORE_PATH_SIZE_LIMIT": "1024",
-		"IP_MIN_RATE_LIMIT":     "4",
-		"IP_HOUR_RATE_LIMIT":    "6",
-		"IP_DAY_RATE_LIMIT":     "10",
+		"IP_MIN_RATE_LIMIT":     "5",
+		"IP_HOUR_RATE_LIMIT":    "7",
+		"IP_DAY_RATE_LIMIT":     "11",
+		"RATE_LIMIT_PERSIST":    "1",
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -24,7 +34,7 @@ func TestApi(t *testing.T) {
 	defer apiContainer.Terminate(ctx) // nolint: errcheck
 	t.Log("Running tests on", baseUrl)
 
-	// File too large
+	// File too large, it counts for the rate limit too
 	jerr := uploadFile(t, baseUrl+"/api/", randomJpegBytes(1024*1024*11), true, nil)
 	if _, ok := jerr["error"]; !ok {
 		t.Fatalf("Expected size limit error to exist. Response was: %v", jerr)
@@ -35,7 +45,8 @@ func TestApi(t *testing.T) {
 	if _, ok := first["url"]; !ok {
 		t.Fatalf("Expected url to exist. Response was: %v", first)
 	}
-	firstUrl := first["url"]
+	// The server is restarted to move its rate limits in time, which changes its port
+	firstPath := strings.TrimPrefix(first["url"], baseUrl)
 
 	// Minute rate limit
 	for i := 0; i < 3; i++ {
@@ -69,6 +80,7 @@ func TestApi(t *testing.T) {
 	if err := dbTimeOffset(t, apiContainer, -5*60); err != nil {
 		t.Fatal(err)
 	}
+	baseUrl = rateLimitTimeOffset(t, apiContainer, -5*60)
 
 	// Now upload should work 2 times
 	for i := 0; i < 2; i++ {
@@ -100,10 +112,11 @@ func TestApi(t *testing.T) {
 		t.Fatalf("Expected rate limit error to exist. Response was: %v", jerr)
 	}
 
-	// Change time in database to simulate 1 hour later
+	// Change time in database to simulate 2 hours later
 	if err := dbTimeOffset(t, apiContainer, -120*60); err != nil {
 		t.Fatal(err)
 	}
+	baseUrl = rateLimitTimeOffset(t, apiContainer, -120*60)
 
 	// Now upload should work 4 times
 	for i := 0; i < 4; i++ {
@@ -129,14 +142,75 @@ func TestApi(t *testing.T) {
 	}
 
 	// The first file should be deleted now for time limit
-	resp, err := http.Get(firstUrl)
+	if status := waitForStatus(t, baseUrl+firstPath, http.StatusNotFound, 5*time.Second); status != http.StatusNotFound {
+		dumpContainerLogs(t, apiContainer)
+		dumpDatabase(t, apiContainer)
+		t.Fatalf("Expected status code %d but got %d", http.StatusNotFound, status)
+	}
+}
+
+// Uploads over FILE_SIZE_LIMIT are rejected without leaving anything behind
+func TestOversizedUpload(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{
+		"FILE_SIZE_LIMIT": "1",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.StatusCode != http.StatusNotFound {
-		dumpContainerLogs(t, apiContainer)
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	content, err := io.ReadAll(randomJpegBytes(1024*1024 + 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(method string, url string, body io.Reader, contentType string) int {
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		return resp.StatusCode
+	}
+
+	form := &bytes.Buffer{}
+	writer := multipart.NewWriter(form)
+	part, err := writer.CreateFormFile("file", "file.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if status := upload(http.MethodPost, baseUrl+"/api/", form, writer.FormDataContentType()); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status code %d but got %d", http.StatusRequestEntityTooLarge, status)
+	}
+	if status := upload(http.MethodPut, baseUrl+"/api/docs/big.jpg", bytes.NewReader(content), ""); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status code %d but got %d", http.StatusRequestEntityTooLarge, status)
+	}
+
+	code, reader, err := apiContainer.Exec(ctx, []string{"sh", "-c", "! ls -A " + api.DEFAULT_STORE_PATH + " | grep -q '^.upload-'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		logReader(t, reader)
+		t.Fatal("Expected the temporary files of rejected uploads to be deleted")
+	}
+	if count := countRows(t, apiContainer, "files"); count != 0 {
 		dumpDatabase(t, apiContainer)
-		t.Fatalf("Expected status code %d but got %d", http.StatusNotFound, resp.StatusCode)
+		t.Fatalf("Expected no file rows but got %d", count)
 	}
 }
 
@@ -174,13 +248,825 @@ func TestStorageLimit(t *testing.T) {
 	}
 
 	// The first file should be deleted now for storage limit
-	resp, err := http.Get(firstUrl)
+	if status := waitForStatus(t, firstUrl, http.StatusNotFound, 5*time.Second); status != http.StatusNotFound {
+		dumpContainerLogs(t, apiContainer)
+		dumpDatabase(t, apiContainer)
+		t.Fatalf("Expected status code %d but got %d", http.StatusNotFound, status)
+	}
+}
+
+// Files are served with support for single and multiple byte ranges
+func TestRangeRequests(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	fileBytes := &bytes.Buffer{}
+	j := uploadFile(t, baseUrl+"/api/", io.TeeReader(randomJpegBytes(1024*1024), fileBytes), false, nil)
+	if _, ok := j["url"]; !ok {
+		t.Fatalf("Expected url to exist. Response was: %v", j)
+	}
+
+	req, err := http.NewRequest("GET", j["url"], nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Range", "bytes=100-199")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected status code %d but got %d", http.StatusPartialContent, resp.StatusCode)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Expected Accept-Ranges to be bytes but got %q", resp.Header.Get("Accept-Ranges"))
+	}
+	if resp.Header.Get("Content-Length") != "100" {
+		t.Fatalf("Expected Content-Length to be 100 but got %q", resp.Header.Get("Content-Length"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, fileBytes.Bytes()[100:200]) {
+		t.Fatalf("Expected range content to match the uploaded file")
+	}
+
+	// Multiple ranges are answered with a multipart body
+	req.Header.Set("Range", "bytes=0-9,20-29")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected status code %d but got %d", http.StatusPartialContent, resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("Expected multipart/byteranges but got %q", resp.Header.Get("Content-Type"))
+	}
+}
+
+// Uploaders can delete their files with the token they receive
+func TestDeleteToken(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	j := uploadFile(t, baseUrl+"/api/", randomJpegBytes(1024), false, nil)
+	token, ok := j["delete_token"]
+	if !ok || token == "" {
+		t.Fatalf("Expected delete_token to exist. Response was: %v", j)
+	}
+	fileUrl := j["url"]
+	deleteUrl := strings.Replace(fileUrl, baseUrl, baseUrl+"/api", 1)
+
+	deleteFile := func(token string) int {
+		req, err := http.NewRequest("DELETE", deleteUrl, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Delete-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		return resp.StatusCode
+	}
+
+	if status := deleteFile("wrong"); status != http.StatusForbidden {
+		t.Fatalf("Expected status code %d but got %d", http.StatusForbidden, status)
+	}
+	if status := deleteFile(token); status != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, status)
+	}
+	if status := deleteFile(token); status != http.StatusNotFound {
+		t.Fatalf("Expected status code %d but got %d", http.StatusNotFound, status)
+	}
+
+	resp, err := http.Get(fileUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
 	if resp.StatusCode != http.StatusNotFound {
-		dumpContainerLogs(t, apiContainer)
-		dumpDatabase(t, apiContainer)
 		t.Fatalf("Expected status code %d but got %d", http.StatusNotFound, resp.StatusCode)
 	}
 }
+
+func TestPasswordProtected(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{
+		"IP_MIN_AUTH_FAILURE_LIMIT": "3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	content, err := io.ReadAll(randomJpegBytes(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := uploadFile(t, baseUrl+"/api/", bytes.NewReader(content), false, map[string]string{"X-Girafiles-Password": "hunter2"})
+	fileUrl := j["url"]
+
+	getFile := func(method string, password string) *http.Response {
+		req, err := http.NewRequest(method, fileUrl, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if password != "" {
+			req.Header.Set("X-Girafiles-Password", password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, password := range []string{"", "wrong"} {
+		resp := getFile("GET", password)
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected status code %d but got %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+
+	resp := getFile("HEAD", "")
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Length") != "" && resp.Header.Get("Content-Length") != "0" {
+		t.Fatalf("Expected no size for a locked file, got %s", resp.Header.Get("Content-Length"))
+	}
+
+	resp = getFile("GET", "hunter2")
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatal("Expected the unlocked content to match the upload")
+	}
+
+	// Guessing is limited like failed logins, even the right password is not checked afterwards
+	for i := 0; i < 2; i++ {
+		resp := getFile("GET", "wrong")
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected status code %d but got %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+	resp = getFile("GET", "hunter2")
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status code %d after too many wrong passwords but got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+}
+
+func TestDigestHeader(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	content, err := io.ReadAll(randomJpegBytes(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	j := uploadFile(t, baseUrl+"/api/", bytes.NewReader(content), false, nil)
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req, err := http.NewRequest(method, j["url"], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() // nolint: errcheck
+
+		expected := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+		if digest := resp.Header.Get("Digest"); digest != expected {
+			t.Fatalf("Expected Digest %s for %s, got %s", expected, method, digest)
+		}
+		if etag := resp.Header.Get("ETag"); etag != fmt.Sprintf("\"%x\"", sum) {
+			t.Fatalf("Expected ETag of the SHA-256 for %s, got %s", method, etag)
+		}
+	}
+}
+
+func TestOriginalFilename(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	j := uploadFile(t, baseUrl+"/api/", randomJpegBytes(1024), false, nil)
+	resp, err := http.Get(j["url"] + "?download=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	expected := `attachment; filename="file.jpg"; filename*=UTF-8''file.jpg`
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != expected {
+		t.Fatalf("Expected Content-Disposition %s, got %s", expected, disposition)
+	}
+}
+
+func TestSharedBlob(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	content, err := io.ReadAll(randomJpegBytes(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := uploadFile(t, baseUrl+"/api/", bytes.NewReader(content), false, nil)
+	second := uploadFile(t, baseUrl+"/api/", bytes.NewReader(content), false, nil)
+	if first["url"] == second["url"] {
+		t.Fatalf("Expected a re-upload to get its own url, got %s twice", first["url"])
+	}
+	if second["delete_token"] == "" {
+		t.Fatalf("Expected a re-upload to get its own delete_token. Response was: %v", second)
+	}
+
+	// Deleting one of them keeps the content of the other
+	req, err := http.NewRequest("DELETE", strings.Replace(first["url"], baseUrl, baseUrl+"/api", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Delete-Token", first["delete_token"])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	got, err := io.ReadAll(getFile(t, second["url"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("Expected the second upload to still be available")
+	}
+}
+
+// fsck finds files whose contents went missing and deletes them with --repair
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{
+		"USERS": "admin:secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+	j := uploadFile(t, baseUrl+"/api/", randomJpegBytes(1024), false, map[string]string{"Authorization": auth})
+	if _, ok := j["url"]; !ok {
+		t.Fatalf("Expected url to exist. Response was: %v", j)
+	}
+
+	// Lose the contents behind the database's back
+	if _, _, err := apiContainer.Exec(ctx, []string{"sh", "-c", "rm " + api.DEFAULT_STORE_PATH + "/" + api.FILEDIR + "/*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fsck := func(method string) api.FsckReport {
+		req, err := http.NewRequest(method, baseUrl+"/api/fsck", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+		var report api.FsckReport
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	report := fsck(http.MethodGet)
+	if len(report.Problems) != 1 || report.Problems[0].Kind != api.FSCK_MISSING_BLOB || report.Problems[0].Repaired {
+		t.Fatalf("Expected one unrepaired missing blob. Report was: %+v", report)
+	}
+
+	report = fsck(http.MethodPost)
+	if len(report.Problems) != 1 || !report.Problems[0].Repaired {
+		t.Fatalf("Expected the missing blob to be repaired. Report was: %+v", report)
+	}
+	if report = fsck(http.MethodGet); len(report.Problems) != 0 {
+		t.Fatalf("Expected no problems after repairing. Report was: %+v", report)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, j["url"], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", auth)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status code %d but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// Files with a download limit are deleted with their contents after their last download
+func TestMaxDownloads(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	content, err := io.ReadAll(randomJpegBytes(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := uploadFile(t, baseUrl+"/api/?max_downloads=2", bytes.NewReader(content), false, nil)
+	fileUrl, ok := j["url"]
+	if !ok {
+		t.Fatalf("Expected url to exist. Response was: %v", j)
+	}
+	infoUrl := strings.Replace(fileUrl, baseUrl, baseUrl+"/info", 1)
+
+	request := func(method string, url string, ranges string) (int, []byte) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ranges != "" {
+			req.Header.Set("Range", ranges)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+	downloadsLeft := func(expected int) {
+		status, body := request(http.MethodGet, infoUrl, "")
+		if status != http.StatusOK || !strings.Contains(string(body), fmt.Sprintf("Deleted after %d more download(s)", expected)) {
+			t.Fatalf("Expected %d downloads to be left, got %d %s", expected, status, body)
+		}
+	}
+
+	// HEAD does not use up a download
+	if status, _ := request(http.MethodHead, fileUrl, ""); status != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, status)
+	}
+	downloadsLeft(2)
+
+	// Ranges do, or the file could be read a few bytes short of its end forever
+	if status, body := request(http.MethodGet, fileUrl, fmt.Sprintf("bytes=0-%d", len(content)-2)); status != http.StatusPartialContent || !bytes.Equal(body, content[:len(content)-1]) {
+		t.Fatalf("Expected status code %d but got %d", http.StatusPartialContent, status)
+	}
+	downloadsLeft(1)
+
+	// The last download gets the whole file, the next one nothing
+	if status, body := request(http.MethodGet, fileUrl, ""); status != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("Expected the last download to succeed, got %d", status)
+	}
+	if status, _ := request(http.MethodGet, fileUrl, ""); status != http.StatusNotFound {
+		t.Fatalf("Expected status code %d after the last download but got %d", http.StatusNotFound, status)
+	}
+
+	// The content is deleted once the last download finished
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, _, err := apiContainer.Exec(ctx, []string{"sh", "-c", "test -z \"$(ls -A " + api.DEFAULT_STORE_PATH + "/" + api.FILEDIR + ")\""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			dumpContainerLogs(t, apiContainer)
+			t.Fatal("Expected the blob of the burned file to be deleted")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// A burned link is used up by a short range too
+	j = uploadFile(t, baseUrl+"/api/?burn=true", bytes.NewReader(content), false, nil)
+	if status, _ := request(http.MethodGet, j["url"], "bytes=0-0"); status != http.StatusPartialContent {
+		t.Fatalf("Expected status code %d but got %d", http.StatusPartialContent, status)
+	}
+	if status, _ := request(http.MethodGet, j["url"], "bytes=0-0"); status != http.StatusNotFound {
+		t.Fatalf("Expected status code %d after the range used up the link but got %d", http.StatusNotFound, status)
+	}
+}
+
+// With DOWNLOAD_AUTH=per-file only files uploaded as private need credentials
+func TestPrivateDownloads(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{
+		"DOWNLOAD_AUTH": api.DOWNLOAD_AUTH_PER_FILE,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	public := uploadFile(t, baseUrl+"/api/", randomJpegBytes(1024), false, map[string]string{})["url"]
+	private := uploadFile(t, baseUrl+"/api/", randomJpegBytes(1024), false, map[string]string{"X-Girafiles-Private": "true"})["url"]
+
+	status := func(url string) int {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() // nolint: errcheck
+		return resp.StatusCode
+	}
+	if code := status(public); code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, code)
+	}
+	if code := status(private); code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d but got %d", http.StatusUnauthorized, code)
+	}
+	name := private[strings.LastIndex(private, "/")+1:]
+	if code := status(baseUrl + "/info/" + name); code != http.StatusUnauthorized {
+		t.Fatalf("Expected the info page to need credentials too, got %d", code)
+	}
+
+	// Group pages do not reveal that private files exist
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequest(method, baseUrl+"/group/"+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected status code %d for %s of a group of private files but got %d", http.StatusNotFound, method, resp.StatusCode)
+		}
+	}
+	if code := status(baseUrl + "/group/" + name + "," + public[strings.LastIndex(public, "/")+1:]); code != http.StatusOK {
+		t.Fatalf("Expected the group page of a public file, got %d", code)
+	}
+}
+
+func TestBucketVersions(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{
+		"ALIAS_VERSIONS": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	url := baseUrl + "/api/nightly/app.bin"
+	put := func(query string, content []byte, headers map[string]string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, url+query, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() // nolint: errcheck
+		return resp
+	}
+	get := func(query string) []byte {
+		resp, err := http.Get(baseUrl + "/nightly/app.bin" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status code %d for version '%s' but got %d", http.StatusOK, query, resp.StatusCode)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	content := func() []byte {
+		body, err := io.ReadAll(randomJpegBytes(1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	first, second, third := content(), content(), content()
+	resp := put("", first, map[string]string{"If-None-Match": "*"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	token := resp.Header.Get("X-Bucket-Token")
+	if resp := put("", second, map[string]string{"X-Bucket-Token": token}); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status code %d without overwrite but got %d", http.StatusConflict, resp.StatusCode)
+	}
+	if resp := put("", second, map[string]string{"X-Bucket-Token": token, "If-None-Match": "*"}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("Expected status code %d but got %d", http.StatusPreconditionFailed, resp.StatusCode)
+	}
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(first))
+	if resp := put("", second, map[string]string{"X-Bucket-Token": token, "If-Match": etag}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d with a matching If-Match but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp := put("", third, map[string]string{"X-Bucket-Token": token, "If-Match": etag}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("Expected status code %d with a stale If-Match but got %d", http.StatusPreconditionFailed, resp.StatusCode)
+	}
+	if resp := put("?overwrite=true", third, map[string]string{"X-Bucket-Token": token}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if !bytes.Equal(get(""), third) || !bytes.Equal(get("?version=3"), third) || !bytes.Equal(get("?version=2"), second) {
+		t.Fatal("Expected the current and previous versions to be downloadable")
+	}
+	resp, err = http.Get(baseUrl + "/nightly/app.bin?version=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the first version to be deleted with ALIAS_VERSIONS=2, got %d", resp.StatusCode)
+	}
+}
+
+func TestBucketListing(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	request := func(method string, url string, body io.Reader, token string) *http.Response {
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("X-Bucket-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	list := func(query string, token string) (int, api.BucketListing) {
+		resp := request(http.MethodGet, baseUrl+"/api/builds/"+query, nil, token)
+		defer resp.Body.Close() // nolint: errcheck
+		var listing api.BucketListing
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, listing
+	}
+
+	resp := request(http.MethodPut, baseUrl+"/api/builds/app-1.bin", randomJpegBytes(1024), "")
+	resp.Body.Close() // nolint: errcheck
+	token := resp.Header.Get("X-Bucket-Token")
+	for _, alias := range []string{"app-2.bin", "lib.bin"} {
+		resp := request(http.MethodPut, baseUrl+"/api/builds/"+alias, randomJpegBytes(1024), token)
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status code %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// Only the owner lists a new bucket until it is shown to everyone
+	if status, _ := list("", ""); status != http.StatusNotFound {
+		t.Fatalf("Expected a new bucket not to be listed, got %d", status)
+	}
+	resp = request(http.MethodPatch, baseUrl+"/api/builds/", strings.NewReader(`{"hidden": false}`), "")
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status code %d showing a bucket without its token but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	resp = request(http.MethodPatch, baseUrl+"/api/builds/", strings.NewReader(`{"hidden": false}`), token)
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	status, listing := list("?limit=2", "")
+	if status != http.StatusOK || len(listing.Files) != 2 || listing.Files[0].Alias != "app-1.bin" || listing.Next != "app-2.bin" {
+		t.Fatalf("Expected the first page with 2 files, got %d %+v", status, listing)
+	}
+	if listing.Files[0].Size != 1027 || listing.Files[0].Mimetype != "image/jpeg" {
+		t.Fatalf("Expected the size and type of the file, got %+v", listing.Files[0])
+	}
+	if _, listing := list("?limit=2&after="+listing.Next, ""); len(listing.Files) != 1 || listing.Files[0].Alias != "lib.bin" || listing.Next != "" {
+		t.Fatalf("Expected the last page with lib.bin, got %+v", listing)
+	}
+	if _, listing := list("?prefix=app", ""); len(listing.Files) != 2 {
+		t.Fatalf("Expected 2 files starting with app, got %+v", listing)
+	}
+
+	resp = request(http.MethodPatch, baseUrl+"/api/builds/", strings.NewReader(`{"hidden": true}`), token)
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if status, _ := list("", ""); status != http.StatusNotFound {
+		t.Fatalf("Expected a hidden bucket not to be listed, got %d", status)
+	}
+	if status, _ := list("", token); status != http.StatusOK {
+		t.Fatalf("Expected the owner to list a hidden bucket, got %d", status)
+	}
+}
+
+func TestBucketPaths(t *testing.T) {
+	ctx := context.Background()
+	apiContainer, baseUrl, err := CreateApiContainer(ctx, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiContainer.Terminate(ctx) // nolint: errcheck
+	t.Log("Running tests on", baseUrl)
+
+	token := ""
+	put := func(alias string, content string) int {
+		req, err := http.NewRequest(http.MethodPut, baseUrl+"/api/site/"+alias, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Bucket-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() // nolint: errcheck
+		if token == "" {
+			token = resp.Header.Get("X-Bucket-Token")
+		}
+		return resp.StatusCode
+	}
+	get := func(path string) (int, string, string) {
+		resp, err := http.Get(baseUrl + "/site/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+	}
+
+	index := `<!DOCTYPE html><html><head><link rel="stylesheet" href="../style.css"></head><body>docs</body></html>`
+	for alias, content := range map[string]string{
+		"style.css":          "body { color: red; }",
+		"docs/v2/index.html": index,
+		"docs/v2/guide.txt":  "guide",
+	} {
+		if status := put(alias, content); status != http.StatusOK {
+			t.Fatalf("Expected status code %d uploading %s but got %d", http.StatusOK, alias, status)
+		}
+	}
+	if status := put("p", "paste"); status != http.StatusBadRequest {
+		t.Fatalf("Expected the alias p to be rejected, got %d", status)
+	}
+
+	if status, mimetype, body := get("docs/v2/guide.txt"); status != http.StatusOK || body != "guide" || !strings.HasPrefix(mimetype, "text/plain") {
+		t.Fatalf("Expected the nested file, got %d %s %s", status, mimetype, body)
+	}
+	if status, mimetype, _ := get("style.css"); status != http.StatusOK || !strings.HasPrefix(mimetype, "text/css") {
+		t.Fatalf("Expected the stylesheet to be served as text/css, got %d %s", status, mimetype)
+	}
+	if status, _, body := get("docs/v2/"); status != http.StatusOK || body != index {
+		t.Fatalf("Expected the directory to serve its index.html, got %d %s", status, body)
+	}
+	if status, _, _ := get("docs/"); status != http.StatusNotFound {
+		t.Fatalf("Expected the listing to be hidden until the owner shows it, got %d", status)
+	}
+	req, err := http.NewRequest(http.MethodPatch, baseUrl+"/api/site/", strings.NewReader(`{"hidden": false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Bucket-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d showing the listing but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if status, _, body := get("docs/"); status != http.StatusOK || !strings.Contains(body, `href="./v2/guide.txt"`) {
+		t.Fatalf("Expected the directory without index.html to be listed, got %d %s", status, body)
+	}
+	if status, _, _ := get("nothing/"); status != http.StatusNotFound {
+		t.Fatalf("Expected status code %d for an empty directory but got %d", http.StatusNotFound, status)
+	}
+	// Directories without the trailing slash redirect so relative links keep working
+	if status, _, body := get("docs/v2"); status != http.StatusOK || body != index {
+		t.Fatalf("Expected to be redirected to the directory, got %d %s", status, body)
+	}
+
+	req, err = http.NewRequest(http.MethodOptions, baseUrl+"/site/docs/v2/guide.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status code %d for a preflight of a nested file but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	req, err = http.NewRequest(http.MethodDelete, baseUrl+"/api/site/docs/v2/guide.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Bucket-Token", token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d deleting a nested file but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// Short names keep their paste view
+	url := uploadFile(t, baseUrl+"/api/", strings.NewReader("print('hi')"), false, map[string]string{})["url"]
+	resp, err = http.Get(url + "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the paste view, got %d", resp.StatusCode)
+	}
+}
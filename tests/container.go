@@ -4,26 +4,96 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"mime/multipart"
 	"net/http"
+	"os"
 	"runtime/debug"
 	"testing"
 	"time"
 
 	"github.com/docker/go-connections/nat"
+	"github.com/matheusfillipe/girafiles/api"
 	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/network"
 	"github.com/testcontainers/testcontainers-go/wait"
 )
 
-// Builds dockerfile and runs the container exposing the port 8585
+const POSTGRES_USER = "girafiles"
+
+// Port the api listens on inside its container
+const API_PORT = 8585
+
+// Set TEST_DATABASE=postgres to run the tests against Postgres instead of SQLite
+func testDatabase() string {
+	if os.Getenv("TEST_DATABASE") == api.DIALECT_POSTGRES {
+		return api.DIALECT_POSTGRES
+	}
+	return api.DIALECT_SQLITE
+}
+
+// The api container together with the database it uses, if that runs in its own container
+type apiContainer struct {
+	testcontainers.Container
+	database testcontainers.Container
+	network  *testcontainers.DockerNetwork
+}
+
+func (c *apiContainer) Terminate(ctx context.Context, opts ...testcontainers.TerminateOption) error {
+	err := c.Container.Terminate(ctx, opts...)
+	if c.database != nil {
+		err = errors.Join(err, c.database.Terminate(ctx, opts...), c.network.Remove(ctx))
+	}
+	return err
+}
+
+// Starts Postgres in a new network where the api container can reach it as postgres:5432
+func createPostgresContainer(ctx context.Context) (testcontainers.Container, *testcontainers.DockerNetwork, error) {
+	nw, err := network.New(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image: "postgres:17-alpine",
+			Env: map[string]string{
+				"POSTGRES_USER":     POSTGRES_USER,
+				"POSTGRES_PASSWORD": POSTGRES_USER,
+				"POSTGRES_DB":       POSTGRES_USER,
+			},
+			Networks:       []string{nw.Name},
+			NetworkAliases: map[string][]string{nw.Name: {"postgres"}},
+			// The server restarts once after initializing the database
+			WaitingFor: wait.ForLog("database system is ready to accept connections").WithOccurrence(2),
+		},
+		Started: true,
+	})
+	if err != nil {
+		_ = nw.Remove(ctx)
+		return nil, nil, err
+	}
+	return container, nw, nil
+}
+
+// Builds dockerfile and runs the container exposing API_PORT
 func CreateApiContainer(ctx context.Context, env map[string]string) (testcontainers.Container, string, error) {
-	const apiPort = 8585
-	env["PORT"] = fmt.Sprint(apiPort)
+	env["PORT"] = fmt.Sprint(API_PORT)
 	env["DEBUG"] = "1"
 
+	container := &apiContainer{}
+	if testDatabase() == api.DIALECT_POSTGRES {
+		database, nw, err := createPostgresContainer(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		container.database = database
+		container.network = nw
+		env["DATABASE_URL"] = fmt.Sprintf("postgres://%s:%s@postgres:5432/%s?sslmode=disable", POSTGRES_USER, POSTGRES_USER, POSTGRES_USER)
+	}
+
 	test := "true"
 	req := testcontainers.ContainerRequest{
 		FromDockerfile: testcontainers.FromDockerfile{
@@ -33,30 +103,45 @@ func CreateApiContainer(ctx context.Context, env map[string]string) (testcontain
 			BuildArgs:  map[string]*string{"TESTING": &test},
 		},
 		Env:          env,
-		ExposedPorts: []string{fmt.Sprint(apiPort) + "/tcp"},
-		WaitingFor:   wait.ForListeningPort(nat.Port(fmt.Sprint(apiPort))),
+		ExposedPorts: []string{fmt.Sprint(API_PORT) + "/tcp"},
+		WaitingFor:   wait.ForListeningPort(nat.Port(fmt.Sprint(API_PORT))),
+	}
+	if container.network != nil {
+		req.Networks = []string{container.network.Name}
 	}
 	apiContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
 		ContainerRequest: req,
 		Started:          true,
 	})
 	if err != nil {
+		if container.database != nil {
+			_ = container.database.Terminate(ctx)
+			_ = container.network.Remove(ctx)
+		}
 		return nil, "", err
 	}
+	container.Container = apiContainer
 
-	ip, err := apiContainer.Host(ctx)
+	uri, err := containerUrl(ctx, apiContainer)
 	if err != nil {
 		return nil, "", err
 	}
+	return container, uri, nil
+}
 
-	port, err := apiContainer.MappedPort(ctx, nat.Port(fmt.Sprint(apiPort)))
+// Base URL of the api in container, the port changes when it is restarted
+func containerUrl(ctx context.Context, container testcontainers.Container) (string, error) {
+	ip, err := container.Host(ctx)
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
 
-	uri := fmt.Sprintf("http://%s:%d", ip, port.Int())
+	port, err := container.MappedPort(ctx, nat.Port(fmt.Sprint(API_PORT)))
+	if err != nil {
+		return "", err
+	}
 
-	return apiContainer, uri, nil
+	return fmt.Sprintf("http://%s:%d", ip, port.Int()), nil
 }
 
 func randomJpegBytes(size int) io.Reader {
@@ -142,6 +227,22 @@ func getFile(t *testing.T, url string) io.Reader {
 	return resp.Body
 }
 
+// Polls url until it answers with status. Cleanup happens in the background so it may take a moment
+func waitForStatus(t *testing.T, url string, status int, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode == status || time.Now().After(deadline) {
+			return resp.StatusCode
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
 func dumpContainerLogs(t *testing.T, container testcontainers.Container) {
 	ctx := context.Background()
 	// Wait a little bit for the logs to be written
@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/matheusfillipe/girafiles/api"
 	_ "github.com/mattn/go-sqlite3"
@@ -21,8 +24,19 @@ func logReader(t *testing.T, reader io.Reader) {
 	t.Log(string(bytes))
 }
 
+// Runs a query on the database of the api container, Postgres or SQLite
+func execSQL(container testcontainers.Container, query string) (io.Reader, error) {
+	ctx := context.Background()
+	if c, ok := container.(*apiContainer); ok && c.database != nil {
+		_, reader, err := c.database.Exec(ctx, []string{"psql", "-U", POSTGRES_USER, "-d", POSTGRES_USER, "-c", query})
+		return reader, err
+	}
+	_, reader, err := container.Exec(ctx, []string{"sqlite3", dbPath, query})
+	return reader, err
+}
+
 func dbTimeOffset(t *testing.T, container testcontainers.Container, offset int) error {
-	_, reader, err := container.Exec(context.Background(), []string{"sqlite3", dbPath, fmt.Sprintf("UPDATE files SET timestamp = timestamp + %d", offset)})
+	reader, err := execSQL(container, fmt.Sprintf("UPDATE files SET timestamp = timestamp + %d", offset))
 	if err != nil {
 		return err
 	}
@@ -30,18 +44,68 @@ func dbTimeOffset(t *testing.T, container testcontainers.Container, offset int)
 	return nil
 }
 
+// Moves the rate limits of a server started with RATE_LIMIT_PERSIST=1 offset seconds in time and restarts
+// it so it loads them, rate limits are kept in memory otherwise. Windows that fit twice in the offset start
+// over, longer ones are left as they are. Returns the new base URL of the server
+func rateLimitTimeOffset(t *testing.T, container testcontainers.Container, offset int) string {
+	ctx := context.Background()
+	// Let the server save its latest counters first
+	time.Sleep(api.RATE_LIMIT_PERSIST_INTERVAL + time.Second)
+	reader, err := execSQL(container, fmt.Sprintf("UPDATE rate_limits SET window_start = window_start - 2 * window_seconds WHERE 2 * window_seconds <= %d", -offset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logReader(t, reader)
+
+	if err := container.Stop(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	uri, err := containerUrl(ctx, container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uri
+}
+
 func dumpDatabase(t *testing.T, container testcontainers.Container) {
-	_, reader, err := container.Exec(context.Background(), []string{"sqlite3", dbPath, "SELECT * FROM files;"})
+	reader, err := execSQL(container, "SELECT * FROM files;")
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Log("Database dump:")
 	logReader(t, reader)
 
-	_, reader, err = container.Exec(context.Background(), []string{"sqlite3", dbPath, "SELECT strftime('%s', DATETIME());"})
+	now := "SELECT strftime('%s', DATETIME());"
+	if testDatabase() == api.DIALECT_POSTGRES {
+		now = "SELECT extract(epoch FROM now())::bigint;"
+	}
+	reader, err = execSQL(container, now)
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Log("Current timestamp:")
 	logReader(t, reader)
 }
+
+// Number of rows in a table of the api container database
+func countRows(t *testing.T, container testcontainers.Container, table string) int {
+	reader, err := execSQL(container, "SELECT COUNT(*) FROM "+table+";")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// psql prints a header and a footer around the count, exec output may start with stream headers
+	for _, field := range strings.Fields(string(output)) {
+		if count, err := strconv.Atoi(field); err == nil {
+			return count
+		}
+	}
+	t.Fatalf("Expected a row count but got: %s", output)
+	return 0
+}